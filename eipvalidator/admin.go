@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const initialPhase = "startup"
+
+// control holds the polling state which can be changed at runtime through the admin endpoints
+type control struct {
+	mu           sync.Mutex
+	paused       bool
+	interval     int
+	phase        string
+	resetPending bool
+	// notified on every change so the polling loop doesn't wait out a full interval
+	changed   chan struct{}
+	phaseInfo *prometheus.GaugeVec
+}
+
+type controlStatus struct {
+	Paused   bool   `json:"paused"`
+	Interval int    `json:"interval"`
+	Phase    string `json:"phase"`
+}
+
+func newControl(interval int) *control {
+	phaseInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "scale",
+		Name:      "eip_phase_info",
+		Help:      "set to 1 for the current measurement phase, started at startup or by the admin reset endpoint",
+	}, []string{"phase"})
+	prometheus.MustRegister(phaseInfo)
+	phaseInfo.WithLabelValues(initialPhase).Set(1)
+	return &control{
+		interval:  interval,
+		phase:     initialPhase,
+		changed:   make(chan struct{}, 1),
+		phaseInfo: phaseInfo,
+	}
+}
+
+func (c *control) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *control) status() controlStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return controlStatus{Paused: c.paused, Interval: c.interval, Phase: c.phase}
+}
+
+func (c *control) setPaused(paused bool) {
+	c.mu.Lock()
+	c.paused = paused
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *control) setInterval(interval int) {
+	c.mu.Lock()
+	c.interval = interval
+	c.mu.Unlock()
+	c.notify()
+}
+
+// request the polling loop to reset latency state and start a new phase
+func (c *control) reset(phase string) {
+	c.mu.Lock()
+	c.phaseInfo.DeleteLabelValues(c.phase)
+	c.phase = phase
+	c.phaseInfo.WithLabelValues(phase).Set(1)
+	c.resetPending = true
+	c.mu.Unlock()
+	c.notify()
+}
+
+// Return the phase to start if a reset was requested since the last call
+func (c *control) takeReset() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.resetPending {
+		return "", false
+	}
+	c.resetPending = false
+	return c.phase, true
+}
+
+func (c *control) registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/status", c.handleStatus)
+	mux.HandleFunc("/admin/pause", c.handlePause)
+	mux.HandleFunc("/admin/resume", c.handleResume)
+	mux.HandleFunc("/admin/reset", c.handleReset)
+	mux.HandleFunc("/admin/interval", c.handleInterval)
+}
+
+func (c *control) writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.status()); err != nil {
+		log.Printf("Error: failed to encode admin status: %v", err)
+	}
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (c *control) handleStatus(w http.ResponseWriter, r *http.Request) {
+	c.writeStatus(w)
+}
+
+func (c *control) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	c.setPaused(true)
+	log.Print("Admin: polling paused")
+	c.writeStatus(w)
+}
+
+func (c *control) handleResume(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	c.setPaused(false)
+	log.Print("Admin: polling resumed")
+	c.writeStatus(w)
+}
+
+// POST /admin/reset?phase=<label>
+func (c *control) handleReset(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	phase := r.URL.Query().Get("phase")
+	if phase == "" {
+		http.Error(w, "query parameter phase is required", http.StatusBadRequest)
+		return
+	}
+	c.reset(phase)
+	log.Printf("Admin: latency state reset, starting phase %q", phase)
+	c.writeStatus(w)
+}
+
+// POST /admin/interval?seconds=<n>
+func (c *control) handleInterval(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	secondsStr := r.URL.Query().Get("seconds")
+	seconds, err := strconv.Atoi(secondsStr)
+	if err != nil || seconds < 0 {
+		http.Error(w, fmt.Sprintf("invalid seconds %q: non-negative integer required", secondsStr), http.StatusBadRequest)
+		return
+	}
+	c.setInterval(seconds)
+	log.Printf("Admin: polling interval set to %d seconds", seconds)
+	c.writeStatus(w)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newControl registers the phase metric, so a single control drives all the
+// admin endpoints in order
+func TestAdminEndpoints(t *testing.T) {
+	log.SetOutput(io.Discard)
+	ctl := newControl(10)
+	mux := http.NewServeMux()
+	ctl.registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		status int
+		want   controlStatus
+		// whether the polling loop is woken up
+		notified bool
+	}{
+		{"status", http.MethodGet, "/admin/status", http.StatusOK, controlStatus{Interval: 10, Phase: initialPhase}, false},
+		{"pause", http.MethodPost, "/admin/pause", http.StatusOK, controlStatus{Paused: true, Interval: 10, Phase: initialPhase}, true},
+		{"pause with GET", http.MethodGet, "/admin/pause", http.StatusMethodNotAllowed, controlStatus{}, false},
+		{"resume", http.MethodPost, "/admin/resume", http.StatusOK, controlStatus{Interval: 10, Phase: initialPhase}, true},
+		{"reset", http.MethodPost, "/admin/reset?phase=failover-1", http.StatusOK, controlStatus{Interval: 10, Phase: "failover-1"}, true},
+		{"reset without phase", http.MethodPost, "/admin/reset", http.StatusBadRequest, controlStatus{}, false},
+		{"reset with empty phase", http.MethodPost, "/admin/reset?phase=", http.StatusBadRequest, controlStatus{}, false},
+		{"interval", http.MethodPost, "/admin/interval?seconds=0", http.StatusOK, controlStatus{Interval: 0, Phase: "failover-1"}, true},
+		{"interval without seconds", http.MethodPost, "/admin/interval", http.StatusBadRequest, controlStatus{}, false},
+		{"negative interval", http.MethodPost, "/admin/interval?seconds=-1", http.StatusBadRequest, controlStatus{}, false},
+		{"interval not a number", http.MethodPost, "/admin/interval?seconds=1.5", http.StatusBadRequest, controlStatus{}, false},
+		{"interval with GET", http.MethodGet, "/admin/interval?seconds=5", http.StatusMethodNotAllowed, controlStatus{}, false},
+		{"status after changes", http.MethodGet, "/admin/status", http.StatusOK, controlStatus{Interval: 0, Phase: "failover-1"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, server.URL+tc.path, nil)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+			if tc.status == http.StatusOK {
+				var status controlStatus
+				if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if status != tc.want {
+					t.Errorf("expected %+v, got %+v", tc.want, status)
+				}
+			}
+			select {
+			case <-ctl.changed:
+				if !tc.notified {
+					t.Error("expected the polling loop left alone")
+				}
+			default:
+				if tc.notified {
+					t.Error("expected the polling loop woken up")
+				}
+			}
+		})
+	}
+
+	// the reset is handed to the polling loop once, with the phase metric moved to the new phase
+	if phase, ok := ctl.takeReset(); !ok || phase != "failover-1" {
+		t.Errorf("expected a reset to phase failover-1, got %q, %v", phase, ok)
+	}
+	if _, ok := ctl.takeReset(); ok {
+		t.Error("expected the reset taken only once")
+	}
+	if n := testutil.CollectAndCount(ctl.phaseInfo); n != 1 {
+		t.Errorf("expected a single phase labeled, got %d", n)
+	}
+	if v := testutil.ToFloat64(ctl.phaseInfo.WithLabelValues("failover-1")); v != 1 {
+		t.Errorf("expected phase failover-1 set, got %v", v)
+	}
+}
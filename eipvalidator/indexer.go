@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	esServerEnvKey     = "ES_SERVER"
+	esIndexEnvKey      = "ES_INDEX"
+	esRetriesEnvKey    = "ES_RETRIES"
+	uuidEnvKey         = "UUID"
+	metadataEnvKey     = "METADATA"
+	defaultESIndex     = "eipvalidator"
+	defaultESRetries   = 3
+	indexerBatchSize   = 100
+	indexerQueueSize   = 1000
+	indexerHTTPTimeout = 10 * time.Second
+	// the final flush must end within the default termination grace period
+	// of 30 seconds, or the run summary is lost when the pod is killed
+	indexerFlushTimeout = 20 * time.Second
+)
+
+// common fields of every document indexed by the validator
+type docMeta struct {
+	MetricName string                 `json:"metricName"`
+	Timestamp  time.Time              `json:"timestamp"`
+	UUID       string                 `json:"uuid"`
+	Phase      string                 `json:"phase"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// indexed once for every recovery from an Egress IP failure
+type failoverDoc struct {
+	docMeta
+	Address      string    `json:"address"`
+	FailureStart time.Time `json:"failureStart"`
+	RecoveredAt  time.Time `json:"recoveredAt"`
+	Latency      float64   `json:"latency"`
+	Sequence     int       `json:"sequence"`
+}
+
+// indexed once when the validator stops polling
+type summaryDoc struct {
+	docMeta
+	Target         string    `json:"target"`
+	EgressIPs      []string  `json:"egressIPs,omitempty"`
+	HostSubnet     string    `json:"hostSubnet,omitempty"`
+	PollInterval   int       `json:"pollInterval"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+	StartupLatency *float64  `json:"startupLatency,omitempty"`
+	Failovers      int       `json:"failovers"`
+	MaxRecovery    float64   `json:"maxRecoveryLatency"`
+	AvgRecovery    float64   `json:"avgRecoveryLatency"`
+	EIPTotal       int       `json:"eipTotal"`
+	NonEIPTotal    int       `json:"nonEIPTotal"`
+	StartupNonEIP  int       `json:"startupNonEIPTotal"`
+	FailureTotal   int       `json:"failureTotal"`
+	totalRecovery  float64
+}
+
+func (s *summaryDoc) addFailover(latency float64) {
+	s.Failovers++
+	s.totalRecovery += latency
+	if latency > s.MaxRecovery {
+		s.MaxRecovery = latency
+	}
+}
+
+func (s *summaryDoc) end() {
+	s.EndTime = time.Now().UTC()
+	if s.Failovers > 0 {
+		s.AvgRecovery = s.totalRecovery / float64(s.Failovers)
+	}
+}
+
+// indexer posts documents to an OpenSearch/Elasticsearch compatible bulk endpoint.
+// A nil indexer is valid and discards all documents.
+type indexer struct {
+	bulkURL  string
+	index    string
+	uuid     string
+	metadata map[string]interface{}
+	retries  int
+	client   http.Client
+	docs     chan interface{}
+	// bulk requests and retries give up at flushDeadline once finish is called
+	flushTimeout  time.Duration
+	mu            sync.Mutex
+	flushDeadline time.Time
+}
+
+// Build the indexer from env vars. Indexing is disabled when ES_SERVER is not set.
+func processIndexerEnvVars() *indexer {
+	var err error
+	server := os.Getenv(esServerEnvKey)
+	if server == "" {
+		return nil
+	}
+	index := os.Getenv(esIndexEnvKey)
+	if index == "" {
+		index = defaultESIndex
+	}
+	retries := defaultESRetries
+	retriesStr := os.Getenv(esRetriesEnvKey)
+	if retriesStr != "" {
+		retries, err = strconv.Atoi(retriesStr)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse indexing retries %q: %v", retriesStr, err))
+		}
+	}
+	uuid := os.Getenv(uuidEnvKey)
+	if uuid == "" {
+		uuid = newUUID()
+	}
+	var metadata map[string]interface{}
+	metadataStr := os.Getenv(metadataEnvKey)
+	if metadataStr != "" {
+		if err = json.Unmarshal([]byte(metadataStr), &metadata); err != nil {
+			panic(fmt.Sprintf("failed to parse %s as a JSON object: %v", metadataEnvKey, err))
+		}
+	}
+	return &indexer{
+		bulkURL:  strings.TrimSuffix(server, "/") + "/_bulk",
+		index:    index,
+		uuid:     uuid,
+		metadata: metadata,
+		retries:  retries,
+		client:   http.Client{Timeout: indexerHTTPTimeout},
+		docs:     make(chan interface{}, indexerQueueSize),
+
+		flushTimeout: indexerFlushTimeout,
+	}
+}
+
+// generate a random version 4 UUID for runs started without UUID env var
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate uuid: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (idx *indexer) newDocMeta(metricName, phase string) docMeta {
+	return docMeta{
+		MetricName: metricName,
+		Timestamp:  time.Now().UTC(),
+		UUID:       idx.uuid,
+		Phase:      phase,
+		Metadata:   idx.metadata,
+	}
+}
+
+// queue a document for indexing, dropping it if the queue is full so polling is never blocked
+func (idx *indexer) enqueue(doc interface{}) {
+	if idx == nil {
+		return
+	}
+	select {
+	case idx.docs <- doc:
+	default:
+		log.Printf("Error: indexing queue full, dropping %T document", doc)
+	}
+}
+
+func (idx *indexer) indexFailover(phase, address string, failureStart, recoveredAt time.Time, sequence int) {
+	if idx == nil {
+		return
+	}
+	idx.enqueue(failoverDoc{
+		docMeta:      idx.newDocMeta("eipFailover", phase),
+		Address:      address,
+		FailureStart: failureStart.UTC(),
+		RecoveredAt:  recoveredAt.UTC(),
+		Latency:      recoveredAt.Sub(failureStart).Seconds(),
+		Sequence:     sequence,
+	})
+}
+
+// index the summary of a finished phase
+func (idx *indexer) indexSummary(summary summaryDoc) {
+	if idx == nil {
+		return
+	}
+	summary.docMeta = idx.newDocMeta("eipValidatorSummary", summary.docMeta.Phase)
+	idx.enqueue(summary)
+}
+
+// index the summary of the last phase and stop accepting documents. The
+// remaining documents are flushed within flushTimeout.
+func (idx *indexer) finish(summary summaryDoc) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	idx.flushDeadline = time.Now().Add(idx.flushTimeout)
+	idx.mu.Unlock()
+	summary.docMeta = idx.newDocMeta("eipValidatorSummary", summary.docMeta.Phase)
+	idx.docs <- summary
+	close(idx.docs)
+}
+
+// Index queued documents in batches until the queue is closed
+func (idx *indexer) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	log.Printf("Indexing documents with uuid %s into %q via %s", idx.uuid, idx.index, idx.bulkURL)
+	for doc := range idx.docs {
+		batch := []interface{}{doc}
+	fill:
+		for len(batch) < indexerBatchSize {
+			select {
+			case d, ok := <-idx.docs:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, d)
+			default:
+				break fill
+			}
+		}
+		if err := idx.bulkWithRetry(batch); err != nil {
+			log.Printf("Error: failed to index %d documents: %v", len(batch), err)
+		}
+	}
+	log.Print("Finished indexing documents")
+}
+
+func (idx *indexer) bulkWithRetry(batch []interface{}) error {
+	body, err := idx.buildBulkBody(batch)
+	if err != nil {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := idx.flushContext()
+		err = idx.bulk(ctx, body)
+		cancel()
+		if err == nil {
+			log.Printf("Indexed %d documents", len(batch))
+			return nil
+		}
+		if attempt >= idx.retries {
+			return err
+		}
+		log.Printf("Error: indexing attempt %d failed: %v, retrying in %v", attempt+1, err, backoff)
+		if !idx.sleep(backoff) {
+			return fmt.Errorf("flush timeout of %v exceeded: %v", idx.flushTimeout, err)
+		}
+		backoff *= 2
+	}
+}
+
+// Wait for d, returns false when the flush deadline is reached first
+func (idx *indexer) sleep(d time.Duration) bool {
+	ctx, cancel := idx.flushContext()
+	defer cancel()
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Context ending at the flush deadline once finish is called, never before
+func (idx *indexer) flushContext() (context.Context, context.CancelFunc) {
+	idx.mu.Lock()
+	deadline := idx.flushDeadline
+	idx.mu.Unlock()
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+func (idx *indexer) buildBulkBody(batch []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	action, err := json.Marshal(map[string]map[string]string{"index": {"_index": idx.index}})
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range batch {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %T document: %v", doc, err)
+		}
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func (idx *indexer) bulk(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, idx.bulkURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	res, err := idx.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("res.StatusCode %d: %s", res.StatusCode, resBody)
+	}
+	var bulkRes struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.Unmarshal(resBody, &bulkRes); err != nil {
+		return fmt.Errorf("failed to parse bulk response: %v", err)
+	}
+	if bulkRes.Errors {
+		return fmt.Errorf("bulk response reported item errors: %s", resBody)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Bulk endpoint stand-in failing the first failures requests and recording
+// the documents of the others
+type bulkServer struct {
+	*httptest.Server
+	failures int32
+	delay    time.Duration
+	requests atomic.Int32
+	mu       sync.Mutex
+	actions  []map[string]map[string]string
+	docs     []map[string]interface{}
+}
+
+func newBulkServer(t *testing.T, failures int32, delay time.Duration) *bulkServer {
+	b := &bulkServer{failures: failures, delay: delay}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.handleBulk))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *bulkServer) handleBulk(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" || r.Method != http.MethodPost {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if n := b.requests.Add(1); n <= b.failures {
+		// read the body so a client giving up is noticed
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(b.delay):
+		case <-r.Context().Done():
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	scanner := bufio.NewScanner(r.Body)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for line := 0; scanner.Scan(); line++ {
+		if line%2 == 0 {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b.actions = append(b.actions, action)
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.docs = append(b.docs, doc)
+	}
+	w.Write([]byte(`{"errors":false}`))
+}
+
+func newTestIndexer(url string, retries int) *indexer {
+	return &indexer{
+		bulkURL:      url + "/_bulk",
+		index:        "eipvalidator-test",
+		uuid:         "test-uuid",
+		metadata:     map[string]interface{}{"platform": "test"},
+		retries:      retries,
+		client:       http.Client{Timeout: indexerHTTPTimeout},
+		docs:         make(chan interface{}, indexerQueueSize),
+		flushTimeout: indexerFlushTimeout,
+	}
+}
+
+// Run the indexer until finish flushed the summary, returning how long the flush took
+func runIndexer(idx *indexer, summary summaryDoc, docs func()) time.Duration {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go idx.run(wg)
+	docs()
+	start := time.Now()
+	idx.finish(summary)
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestIndexerPostsFailoversAndSummary(t *testing.T) {
+	server := newBulkServer(t, 0, 0)
+	idx := newTestIndexer(server.URL, 0)
+	failureStart := time.Now().Add(-3 * time.Second)
+	summary := summaryDoc{Target: "http://10.0.0.1:9002"}
+	summary.docMeta.Phase = initialPhase
+	summary.addFailover(3)
+	summary.end()
+	runIndexer(idx, summary, func() {
+		idx.indexFailover(initialPhase, "10.0.0.1", failureStart, failureStart.Add(3*time.Second), 1)
+	})
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.docs) != 2 {
+		t.Fatalf("expected 2 documents, got %d: %v", len(server.docs), server.docs)
+	}
+	for i, action := range server.actions {
+		if action["index"]["_index"] != "eipvalidator-test" {
+			t.Errorf("action %d: expected index eipvalidator-test, got %v", i, action)
+		}
+	}
+	for i, want := range []string{"eipFailover", "eipValidatorSummary"} {
+		doc := server.docs[i]
+		if doc["metricName"] != want {
+			t.Errorf("document %d: expected metricName %s, got %v", i, want, doc["metricName"])
+		}
+		if doc["uuid"] != "test-uuid" || doc["phase"] != initialPhase {
+			t.Errorf("document %d: unexpected uuid or phase: %v", i, doc)
+		}
+		if metadata, _ := doc["metadata"].(map[string]interface{}); metadata["platform"] != "test" {
+			t.Errorf("document %d: expected metadata, got %v", i, doc["metadata"])
+		}
+	}
+	if latency := server.docs[0]["latency"]; latency != 3.0 {
+		t.Errorf("expected failover latency 3, got %v", latency)
+	}
+	if failovers := server.docs[1]["failovers"]; failovers != 1.0 {
+		t.Errorf("expected 1 failover in summary, got %v", failovers)
+	}
+}
+
+func TestIndexerRetriesFailedBulk(t *testing.T) {
+	server := newBulkServer(t, 1, 0)
+	idx := newTestIndexer(server.URL, 1)
+	runIndexer(idx, summaryDoc{}, func() {})
+
+	if requests := server.requests.Load(); requests != 2 {
+		t.Errorf("expected 2 bulk requests, got %d", requests)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.docs) != 1 {
+		t.Errorf("expected the summary to be indexed after a retry, got %d documents", len(server.docs))
+	}
+}
+
+func TestIndexerFlushTimeout(t *testing.T) {
+	// every request hangs longer than the flush timeout
+	server := newBulkServer(t, 100, time.Minute)
+	idx := newTestIndexer(server.URL, defaultESRetries)
+	idx.flushTimeout = 500 * time.Millisecond
+	elapsed := runIndexer(idx, summaryDoc{}, func() {})
+
+	if elapsed > 5*time.Second {
+		t.Errorf("expected the final flush to give up after %v, took %v", idx.flushTimeout, elapsed)
+	}
+}
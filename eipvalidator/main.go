@@ -40,11 +40,22 @@ func main() {
 		egressIPs = buildEIPMap(egressIPsStr)
 	}
 	startupNonEIPTick, eipStartUpLatency, eipRecoveryLatency, eipTick, nonEIPTick, failure := buildAndRegisterMetrics(delayBetweenReq)
+	ctl := newControl(delayBetweenReq)
+	resolver := processResolverEnvVars(extHost)
+	if resolver != nil {
+		wg.Add(1)
+		go resolver.run(stop, wg)
+	}
+	idx := processIndexerEnvVars()
+	if idx != nil {
+		wg.Add(1)
+		go idx.run(wg)
+	}
 	wg.Add(2)
-	startMetricsServer(stop, wg)
+	startMetricsServer(stop, wg, ctl)
 	// begin requests until Egress IP found
 	wg.Add(1)
-	go checkEIPAndNonEIPUntilStop(stop, wg, egressIPs, hostSubnetStr, extHost, extPort, eipStartUpLatency, eipRecoveryLatency, startupNonEIPTick, eipTick, nonEIPTick, failure, delayBetweenReq, timeout)
+	go checkEIPAndNonEIPUntilStop(stop, wg, egressIPs, hostSubnetStr, extHost, extPort, eipStartUpLatency, eipRecoveryLatency, startupNonEIPTick, eipTick, nonEIPTick, failure, ctl, resolver, timeout, idx)
 	wg.Wait()
 }
 
@@ -74,7 +85,7 @@ func validateIPAddress(ipAddr string, egressIPs map[string]struct{}, subnet stri
 
 
 func checkEIPAndNonEIPUntilStop(stop <-chan struct{}, wg *sync.WaitGroup, egressIPs map[string]struct{}, hostSubnetStr string, extHost, extPort string,
-        eipStartUpLatency, eipRecoveryLatency *prometheus.Gauge, startupNonEIPTick, eipTick, nonEIPTick *prometheus.Gauge, failure *prometheus.Gauge, delayBetweenReq, timeout int) {
+        eipStartUpLatency, eipRecoveryLatency *prometheus.Gauge, startupNonEIPTick, eipTick, nonEIPTick *prometheus.Gauge, failure *prometheus.Gauge, ctl *control, resolver *targetResolver, timeout int, idx *indexer) {
 	log.Print("## checkEIPAndNonEIPUntilStop: Polling source IP and increment metric counts for when Egress IP or another IP seen as source IP")
 	defer wg.Done()
 	var done bool
@@ -82,16 +93,78 @@ func checkEIPAndNonEIPUntilStop(stop <-chan struct{}, wg *sync.WaitGroup, egress
 	var eipCheckFailed bool
 	var startupLatencySet bool
 	var valid bool
+	// when polling was paused, zero while polling
+	var pausedAt time.Time
 	client := getHTTPClient(timeout)
+	newSummary := func(phase string) summaryDoc {
+		summary := summaryDoc{
+			Target:       buildDstURL(extHost, extPort),
+			HostSubnet:   hostSubnetStr,
+			PollInterval: ctl.status().Interval,
+			StartTime:    start.UTC(),
+		}
+		summary.docMeta.Phase = phase
+		for eip := range egressIPs {
+			summary.EgressIPs = append(summary.EgressIPs, eip)
+		}
+		return summary
+	}
+	summary := newSummary(initialPhase)
 
 	for !done {
+		// start a new measurement phase when requested through the admin endpoint
+		if phase, ok := ctl.takeReset(); ok {
+			summary.end()
+			idx.indexSummary(summary)
+			start = time.Now()
+			pausedAt = time.Time{}
+			eipCheckFailed = false
+			startupLatencySet = false
+			(*eipStartUpLatency).Set(0)
+			(*eipRecoveryLatency).Set(0)
+			summary = newSummary(phase)
+			log.Printf("Starting phase %q", phase)
+		}
+		status := ctl.status()
+		if status.Paused {
+			if pausedAt.IsZero() {
+				pausedAt = time.Now()
+			}
+			select {
+			case <-stop:
+				done = true
+			case <-ctl.changed:
+			}
+			continue
+		}
+		if !pausedAt.IsZero() {
+			// the time spent paused is not part of the startup or recovery latency
+			start = start.Add(time.Since(pausedAt))
+			pausedAt = time.Time{}
+		}
 		select {
 		case <-stop:
 			done = true
 		default:
+			// pick the address to connect to, a DNS failure must not be reported as a connection failure
+			addr := extHost
+			if resolver != nil {
+				var resolved bool
+				if addr, resolved = resolver.pick(); !resolved {
+					log.Printf("Error: no address resolved for %q yet, skipping request", extHost)
+					waitForNextPoll(stop, ctl, status.Interval, unresolvedBackoff)
+					continue
+				}
+				resolver.recordProbe(addr)
+			}
 			// Create a new request
-			url := buildDstURL(extHost, extPort)
-			res, err := client.Get(url)
+			url := buildDstURL(addr, extPort)
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				panic(fmt.Sprintf("failed to build request for %q: %v", url, err))
+			}
+			req.Host = net.JoinHostPort(extHost, extPort)
+			res, err := client.Do(req)
 			if err != nil {
 				log.Printf("Error: Failed to talk to %q: %v", url, err)
 			} else {
@@ -114,38 +187,65 @@ func checkEIPAndNonEIPUntilStop(stop <-chan struct{}, wg *sync.WaitGroup, egress
 					start = time.Now()
 				}
 				(*failure).Inc()
+				summary.FailureTotal++
 			} else {
 				if valid {
+					summary.EIPTotal++
 					if startupLatencySet == false {
-						(*eipStartUpLatency).Set(time.Now().Sub(start).Seconds())
-						log.Printf("Startup Latency %v", time.Now().Sub(start).Seconds())
+						startupLatency := time.Now().Sub(start).Seconds()
+						(*eipStartUpLatency).Set(startupLatency)
+						log.Printf("Startup Latency %v", startupLatency)
+						summary.StartupLatency = &startupLatency
 						startupLatencySet = true
 					} else {
 						if eipCheckFailed == true {
 							eipCheckFailed = false
-							(*eipRecoveryLatency).Set(time.Now().Sub(start).Seconds())
-							log.Printf("Failover Latency %v", time.Now().Sub(start).Seconds())
-							start = time.Now()
+							now := time.Now()
+							recovery := now.Sub(start).Seconds()
+							(*eipRecoveryLatency).Set(recovery)
+							log.Printf("Failover Latency %v", recovery)
+							summary.addFailover(recovery)
+							idx.indexFailover(summary.docMeta.Phase, addr, start, now, summary.Failovers)
+							start = now
 						}
 					}
 				} else {
 					if startupLatencySet == false {
 						(*startupNonEIPTick).Inc()
+						summary.StartupNonEIP++
 					} else {
 						if eipCheckFailed == false {
 							eipCheckFailed = true
 							start = time.Now()
 						}
 						(*nonEIPTick).Inc()
+						summary.NonEIPTotal++
 					}
 				}
 			}
-			if delayBetweenReq != 0 {
-				time.Sleep(time.Duration(delayBetweenReq) * time.Second)
-			}
+			waitForNextPoll(stop, ctl, status.Interval, 0)
 		}
 	}
 	log.Print("Finished polling source IP")
+	summary.end()
+	idx.finish(summary)
+}
+
+// Sleep for the polling interval, at least minWait, waking up early on stop or
+// when the admin endpoints change the polling state
+func waitForNextPoll(stop <-chan struct{}, ctl *control, interval int, minWait time.Duration) {
+	wait := time.Duration(interval) * time.Second
+	if wait < minWait {
+		wait = minWait
+	}
+	if wait == 0 {
+		return
+	}
+	select {
+	case <-stop:
+	case <-ctl.changed:
+	case <-time.After(wait):
+	}
 }
 
 func isIP(s string) bool {
@@ -153,7 +253,7 @@ func isIP(s string) bool {
 }
 
 func buildDstURL(host, port string) string {
-	return fmt.Sprintf("http://%s:%s", host, port)
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, port))
 }
 
 func getHTTPClient(timeout int) http.Client {
@@ -215,7 +315,7 @@ func processEnvVars() (string, string, string, string, int, int) {
 
 func registerSignalHandler() chan struct{} {
 	stop := make(chan struct{})
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -224,10 +324,11 @@ func registerSignalHandler() chan struct{} {
 	return stop
 }
 
-func startMetricsServer(stop <-chan struct{}, wg *sync.WaitGroup) {
+func startMetricsServer(stop <-chan struct{}, wg *sync.WaitGroup, ctl *control) {
 	// build metrics server
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	ctl.registerHandlers(mux)
 	server := &http.Server{Addr: ":8080", Handler: mux}
 	// start metrics server
 	go func() {
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dnsIntervalEnvKey        = "DNS_RESOLVE_INTERVAL_SEC"
+	dnsModeEnvKey            = "DNS_ADDRESS_MODE"
+	defaultDNSIntervalSec    = 30
+	dnsResolveTimeout        = 5 * time.Second
+	dnsModePin               = "pin"
+	dnsModeRotate            = "rotate"
+	defaultDNSAddressMode    = dnsModePin
+	probeAddressMetricLabel  = "address"
+	dnsResolutionMetricsHelp = "resolution of EXT_SERVER_HOST"
+	// probes wait at least this long while no address is resolved, whatever the poll interval
+	unresolvedBackoff = time.Second
+	// distinct addresses probes are recorded under, others are recorded as otherProbeAddress
+	maxProbeAddressLabels = 16
+	otherProbeAddress     = "other"
+)
+
+// targetResolver periodically resolves a hostname target and selects the address each probe uses.
+type targetResolver struct {
+	host     string
+	mode     string
+	interval time.Duration
+
+	// net.DefaultResolver.LookupIPAddr, replaced in tests
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	mu     sync.Mutex
+	addrs  []string
+	next   int
+	pinned string
+	// addresses probe_address_total has a label for
+	labeled map[string]bool
+
+	resolutionLatency prometheus.Gauge
+	resolutionFailure prometheus.Gauge
+	resolvedAddresses prometheus.Gauge
+	probeAddress      *prometheus.GaugeVec
+}
+
+// Build the resolver from env vars. Returns nil when host is an IP address.
+func processResolverEnvVars(host string) *targetResolver {
+	if isIP(host) {
+		return nil
+	}
+	var err error
+	intervalSec := defaultDNSIntervalSec
+	intervalStr := os.Getenv(dnsIntervalEnvKey)
+	if intervalStr != "" {
+		intervalSec, err = strconv.Atoi(intervalStr)
+		if err != nil || intervalSec <= 0 {
+			panic(fmt.Sprintf("failed to parse DNS resolve interval %q: positive integer required", intervalStr))
+		}
+	}
+	mode := os.Getenv(dnsModeEnvKey)
+	if mode == "" {
+		mode = defaultDNSAddressMode
+	}
+	if mode != dnsModePin && mode != dnsModeRotate {
+		panic(fmt.Sprintf("invalid %s %q - %q or %q allowed", dnsModeEnvKey, mode, dnsModePin, dnsModeRotate))
+	}
+	r := newTargetResolver(host, mode, time.Duration(intervalSec)*time.Second)
+	prometheus.MustRegister(r.resolutionLatency)
+	prometheus.MustRegister(r.resolutionFailure)
+	prometheus.MustRegister(r.resolvedAddresses)
+	prometheus.MustRegister(r.probeAddress)
+	log.Printf("Resolving %q every %v, %s mode", host, r.interval, mode)
+	// resolve once before polling starts so that the first probe has an address
+	r.resolve()
+	return r
+}
+
+func newTargetResolver(host, mode string, interval time.Duration) *targetResolver {
+	return &targetResolver{
+		host:     host,
+		mode:     mode,
+		interval: interval,
+		lookup:   net.DefaultResolver.LookupIPAddr,
+		labeled:  make(map[string]bool),
+		resolutionLatency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "scale",
+			Name:      "dns_resolution_latency",
+			Help:      fmt.Sprintf("time it takes in seconds for the last successful %s, resolved every %v", dnsResolutionMetricsHelp, interval),
+		}),
+		resolutionFailure: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "scale",
+			Name:      "dns_resolution_failure_total",
+			Help:      fmt.Sprintf("increments every time the %s fails or returns no address", dnsResolutionMetricsHelp),
+		}),
+		resolvedAddresses: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "scale",
+			Name:      "dns_resolved_addresses",
+			Help:      fmt.Sprintf("number of A/AAAA records returned by the last successful %s", dnsResolutionMetricsHelp),
+		}),
+		probeAddress: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "scale",
+			Name:      "probe_address_total",
+			Help:      fmt.Sprintf("increments every time a probe connects to the resolved address, up to %d addresses currently resolved, %q for the others", maxProbeAddressLabels, otherProbeAddress),
+		}, []string{probeAddressMetricLabel}),
+	}
+}
+
+// Resolve the target every interval until stop
+func (r *targetResolver) run(stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.resolve()
+		}
+	}
+}
+
+// Resolve the target and keep the previous addresses on failure
+func (r *targetResolver) resolve() {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsResolveTimeout)
+	defer cancel()
+	start := time.Now()
+	ipAddrs, err := r.lookup(ctx, r.host)
+	latency := time.Now().Sub(start).Seconds()
+	if err == nil && len(ipAddrs) == 0 {
+		err = fmt.Errorf("no A/AAAA records")
+	}
+	if err != nil {
+		log.Printf("Error: Failed to resolve %q: %v", r.host, err)
+		r.resolutionFailure.Inc()
+		return
+	}
+	addrs := make([]string, 0, len(ipAddrs))
+	for _, ipAddr := range ipAddrs {
+		addrs = append(addrs, ipAddr.IP.String())
+	}
+	sort.Strings(addrs)
+	r.resolutionLatency.Set(latency)
+	r.resolvedAddresses.Set(float64(len(addrs)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !equalAddrs(r.addrs, addrs) {
+		log.Printf("Resolved %q to %v in %v seconds", r.host, addrs, latency)
+	}
+	r.addrs = addrs
+	// addresses no longer resolved free their label, so rotating records don't pile up labels
+	for addr := range r.labeled {
+		if !containsAddr(addrs, addr) {
+			r.probeAddress.DeleteLabelValues(addr)
+			delete(r.labeled, addr)
+		}
+	}
+	if r.pinned != "" && !containsAddr(addrs, r.pinned) {
+		log.Printf("Pinned address %s no longer returned for %q", r.pinned, r.host)
+		r.pinned = ""
+	}
+}
+
+// Return the address the next probe should connect to. Returns false when the
+// target never resolved.
+func (r *targetResolver) pick() (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) == 0 {
+		return "", false
+	}
+	if r.mode == dnsModeRotate {
+		addr := r.addrs[r.next%len(r.addrs)]
+		r.next++
+		return addr, true
+	}
+	if r.pinned == "" {
+		r.pinned = r.addrs[0]
+		log.Printf("Pinned %q to %s", r.host, r.pinned)
+	}
+	return r.pinned, true
+}
+
+// Count a probe to addr, under its own label while fewer than
+// maxProbeAddressLabels addresses have one
+func (r *targetResolver) recordProbe(addr string) {
+	r.mu.Lock()
+	label := addr
+	if !r.labeled[addr] {
+		if len(r.labeled) < maxProbeAddressLabels {
+			r.labeled[addr] = true
+		} else {
+			label = otherProbeAddress
+		}
+	}
+	r.mu.Unlock()
+	r.probeAddress.WithLabelValues(label).Inc()
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// DNS stand-in returning the next answer of answers on every lookup, the last
+// one once they ran out. A nil answer fails the lookup.
+type fakeDNS struct {
+	mu      sync.Mutex
+	answers [][]string
+}
+
+func (d *fakeDNS) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	answer := d.answers[0]
+	if len(d.answers) > 1 {
+		d.answers = d.answers[1:]
+	}
+	if answer == nil {
+		return nil, errors.New("no such host")
+	}
+	ipAddrs := make([]net.IPAddr, 0, len(answer))
+	for _, addr := range answer {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ipAddrs, nil
+}
+
+func newTestResolver(t *testing.T, mode string, answers ...[]string) *targetResolver {
+	log.SetOutput(io.Discard)
+	r := newTargetResolver("server.example.com", mode, time.Second)
+	r.lookup = (&fakeDNS{answers: answers}).lookup
+	return r
+}
+
+// Pick n addresses
+func pickN(t *testing.T, r *targetResolver, n int) []string {
+	t.Helper()
+	picked := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		addr, ok := r.pick()
+		if !ok {
+			t.Fatalf("pick %d: expected a resolved address", i)
+		}
+		picked = append(picked, addr)
+	}
+	return picked
+}
+
+func TestResolverPick(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mode    string
+		answers [][]string
+		want    [][]string
+	}{
+		{
+			name:    "pin keeps the first address",
+			mode:    dnsModePin,
+			answers: [][]string{{"10.0.0.2", "10.0.0.1"}, {"10.0.0.3", "10.0.0.1"}},
+			want:    [][]string{{"10.0.0.1", "10.0.0.1", "10.0.0.1"}, {"10.0.0.1", "10.0.0.1"}},
+		},
+		{
+			name:    "pin moves once the address is gone",
+			mode:    dnsModePin,
+			answers: [][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.3", "10.0.0.2"}},
+			want:    [][]string{{"10.0.0.1", "10.0.0.1"}, {"10.0.0.2", "10.0.0.2"}},
+		},
+		{
+			name:    "rotate goes through every address",
+			mode:    dnsModeRotate,
+			answers: [][]string{{"10.0.0.3", "10.0.0.1", "10.0.0.2"}, {"10.0.0.4"}},
+			want:    [][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}, {"10.0.0.4", "10.0.0.4"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestResolver(t, tc.mode, tc.answers...)
+			if _, ok := r.pick(); ok {
+				t.Fatal("expected no address before the first resolution")
+			}
+			for i, want := range tc.want {
+				r.resolve()
+				if got := pickN(t, r, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("resolution %d: expected %v, got %v", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+// A failed or empty resolution keeps the addresses of the last good one
+func TestResolverKeepsLastResolution(t *testing.T) {
+	for _, mode := range []string{dnsModePin, dnsModeRotate} {
+		t.Run(mode, func(t *testing.T) {
+			r := newTestResolver(t, mode, []string{"10.0.0.1"}, nil, []string{})
+			r.resolve()
+			for i := 0; i < 2; i++ {
+				r.resolve()
+				if got := pickN(t, r, 2); got[0] != "10.0.0.1" || got[1] != "10.0.0.1" {
+					t.Errorf("expected the last resolved address, got %v", got)
+				}
+			}
+			if failures := testutil.ToFloat64(r.resolutionFailure); failures != 2 {
+				t.Errorf("expected 2 failed resolutions, got %v", failures)
+			}
+			if addrs := testutil.ToFloat64(r.resolvedAddresses); addrs != 1 {
+				t.Errorf("expected 1 resolved address, got %v", addrs)
+			}
+		})
+	}
+}
+
+func TestResolverNeverResolved(t *testing.T) {
+	r := newTestResolver(t, dnsModeRotate, nil)
+	r.resolve()
+	if addr, ok := r.pick(); ok {
+		t.Errorf("expected no address, got %s", addr)
+	}
+}
+
+// Addresses get a label while DNS returns them, up to maxProbeAddressLabels
+func TestResolverProbeAddressLabels(t *testing.T) {
+	first := make([]string, 0, maxProbeAddressLabels+2)
+	for i := 0; i < maxProbeAddressLabels+2; i++ {
+		first = append(first, fmt.Sprintf("10.0.0.%d", i+1))
+	}
+	r := newTestResolver(t, dnsModeRotate, first, []string{"10.0.1.1"})
+	r.resolve()
+	for _, addr := range pickN(t, r, len(first)) {
+		r.recordProbe(addr)
+	}
+	if n := testutil.CollectAndCount(r.probeAddress); n != maxProbeAddressLabels+1 {
+		t.Errorf("expected %d addresses and %q labeled, got %d labels", maxProbeAddressLabels, otherProbeAddress, n)
+	}
+	if other := testutil.ToFloat64(r.probeAddress.WithLabelValues(otherProbeAddress)); other != 2 {
+		t.Errorf("expected 2 probes counted as %q, got %v", otherProbeAddress, other)
+	}
+
+	r.resolve()
+	r.recordProbe(pickN(t, r, 1)[0])
+	if n := testutil.CollectAndCount(r.probeAddress); n != 2 {
+		t.Errorf("expected only the address still resolved and %q labeled, got %d labels", otherProbeAddress, n)
+	}
+	if probes := testutil.ToFloat64(r.probeAddress.WithLabelValues("10.0.1.1")); probes != 1 {
+		t.Errorf("expected 1 probe to the new address, got %v", probes)
+	}
+}
+
+// With nothing resolved and no polling interval, probes still back off
+func TestWaitForNextPollMinWait(t *testing.T) {
+	ctl := &control{changed: make(chan struct{}, 1)}
+	start := time.Now()
+	waitForNextPoll(make(chan struct{}), ctl, 0, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait at least 50ms, waited %v", elapsed)
+	}
+	start = time.Now()
+	waitForNextPoll(make(chan struct{}), ctl, 0, 0)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("expected no wait without interval, waited %v", elapsed)
+	}
+}
@@ -0,0 +1,292 @@
+package netpolprotocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned when an endpoint replies with an unexpected status code
+type StatusError struct {
+	StatusCode int
+	// decoded body of proxy errors, nil otherwise
+	Response *ErrorResponse
+}
+
+func (e *StatusError) Error() string {
+	if e.Response != nil && e.Response.Error != "" {
+		msg := fmt.Sprintf("unexpected status code: %d: %s", e.StatusCode, e.Response.Error)
+		if len(e.Response.Details) > 0 {
+			msg += ": " + strings.Join(e.Response.Details, "; ")
+		}
+		return msg
+	}
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// Send a request with an optional JSON body, compressed with gzip when
+// compress is set. Returns the response with its body to be closed by the
+// caller when the status code is 200 OK, a StatusError otherwise.
+// Compressed responses are decompressed by the transport.
+func send(ctx context.Context, client *http.Client, method, url, token string, in interface{}, compress bool) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal payload: %v", err)
+		}
+		if compress {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(data)
+			if err := gz.Close(); err != nil {
+				return nil, fmt.Errorf("failed to compress payload: %v", err)
+			}
+			data = buf.Bytes()
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		statusErr := &StatusError{StatusCode: resp.StatusCode}
+		var errResp ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil {
+			statusErr.Response = &errResp
+		}
+		return resp, statusErr
+	}
+	return resp, nil
+}
+
+// Send a request as send does and decode the JSON reply into out, unless out is nil
+func do(ctx context.Context, client *http.Client, method, url, token string, in, out interface{}, compress bool) (*http.Response, error) {
+	resp, err := send(ctx, client, method, url, token, in, compress)
+	if err != nil {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("failed to decode response: %v", err)
+		}
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+	return resp, nil
+}
+
+// Maps the pod keys of connections, e.g. pod IPs or pod names, to the host:port
+// of client pods
+type Resolver interface {
+	Resolve(ctx context.Context, pod string) (string, error)
+}
+
+// Client of the endpoints of netpolvalidator client pods, used by the proxy
+type PodClient struct {
+	HTTPClient *http.Client
+	// http or https
+	Scheme string
+	Port   int
+	// when nil, pod keys are used as hosts listening on Port
+	Resolver Resolver
+}
+
+// Return the URL of path on pod
+func (c *PodClient) URL(ctx context.Context, pod, path string) (string, error) {
+	hostPort := net.JoinHostPort(pod, strconv.Itoa(c.Port))
+	if c.Resolver != nil {
+		var err error
+		if hostPort, err = c.Resolver.Resolve(ctx, pod); err != nil {
+			return "", fmt.Errorf("failed to resolve pod %s: %v", pod, err)
+		}
+	}
+	return fmt.Sprintf("%s://%s%s", c.Scheme, hostPort, path), nil
+}
+
+// Send the connections a client pod must test, to /check
+func (c *PodClient) SendConnections(ctx context.Context, pod string, conns []Connection) error {
+	return c.Deliver(ctx, pod, "/check", conns)
+}
+
+// Send the connections a client pod must test to path, the endpoint of a
+// workload type, e.g. /check for network policies or /reach for HTTP targets
+func (c *PodClient) Deliver(ctx context.Context, pod, path string, conns []Connection) error {
+	url, err := c.URL(ctx, pod, path)
+	if err != nil {
+		return err
+	}
+	_, err = do(ctx, c.HTTPClient, http.MethodPost, url, "", conns, nil, false)
+	return err
+}
+
+// Retrieve the results of a client pod, from /results
+func (c *PodClient) Results(ctx context.Context, pod string) ([]ConnTest, error) {
+	url, err := c.URL(ctx, pod, "/results")
+	if err != nil {
+		return nil, err
+	}
+	var results []ConnTest
+	_, err = do(ctx, c.HTTPClient, http.MethodGet, url, "", nil, &results, false)
+	return results, err
+}
+
+// Retrieve the results of a client pod as Results does, decoding them in
+// batches of up to batchSize results passed to fn, which must not retain them
+func (c *PodClient) StreamResults(ctx context.Context, pod string, batchSize int, fn func(batch []ConnTest) error) error {
+	url, err := c.URL(ctx, pod, "/results")
+	if err != nil {
+		return err
+	}
+	resp, err := send(ctx, c.HTTPClient, http.MethodGet, url, "", nil, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return DecodeResults(resp.Body, batchSize, fn)
+}
+
+// Retrieve the HTTP reachability results of a client pod in batches, as
+// StreamResults does
+func (c *PodClient) StreamReachResults(ctx context.Context, pod string, batchSize int, fn func(batch []ReachResult) error) error {
+	url, err := c.URL(ctx, pod, "/results")
+	if err != nil {
+		return err
+	}
+	resp, err := send(ctx, c.HTTPClient, http.MethodGet, url, "", nil, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return DecodeReachResults(resp.Body, batchSize, fn)
+}
+
+// Read the clock of a client pod, from /time
+func (c *PodClient) Time(ctx context.Context, pod string) (time.Time, error) {
+	url, err := c.URL(ctx, pod, "/time")
+	if err != nil {
+		return time.Time{}, err
+	}
+	var resp TimeResponse
+	_, err = do(ctx, c.HTTPClient, http.MethodGet, url, "", nil, &resp, false)
+	return resp.Time, err
+}
+
+// Client of the endpoints of the netpolproxy pod, used by kube-burner and by
+// client pods pushing their results
+type ProxyClient struct {
+	HTTPClient *http.Client
+	// e.g. http://netpolproxy:9002
+	BaseURL string
+	// bearer token of the proxy, if any
+	Token string
+	// compress request bodies with gzip, which older proxies don't accept
+	Compress bool
+}
+
+func (c *ProxyClient) url(path, session string) string {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if session != "" {
+		u += "?session=" + url.QueryEscape(session)
+	}
+	return u
+}
+
+// Start a session with the connections of every client pod, to /initiate.
+// session is the requested session ID, empty to let the proxy number it.
+// Returns the ID of the session.
+func (c *ProxyClient) Initiate(ctx context.Context, session string, req InitiateRequest) (string, error) {
+	if req.SchemaVersion == 0 {
+		req.SchemaVersion = LatestSchemaVersion
+	}
+	resp, err := do(ctx, c.HTTPClient, http.MethodPost, c.url("/initiate", session), c.Token, req, nil, c.Compress)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("X-Session-Id"), nil
+}
+
+// Start a session of the http workload with the targets of every client pod,
+// as Initiate does
+func (c *ProxyClient) InitiateReachability(ctx context.Context, session string, req ReachabilityRequest) (string, error) {
+	u := c.url("/initiate", session)
+	if session == "" {
+		u += "?workload=" + WorkloadHTTP
+	} else {
+		u += "&workload=" + WorkloadHTTP
+	}
+	resp, err := do(ctx, c.HTTPClient, http.MethodPost, u, c.Token, req, nil, c.Compress)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("X-Session-Id"), nil
+}
+
+// Check whether connections were sent to all client pods, with /checkConnectionsStatus
+func (c *ProxyClient) ConnectionsStatus(ctx context.Context, session string) (ProxyResponse, error) {
+	var status ProxyResponse
+	_, err := do(ctx, c.HTTPClient, http.MethodGet, c.url("/checkConnectionsStatus", session), c.Token, nil, &status, c.Compress)
+	return status, err
+}
+
+// Request the results of the session to be collected, with /stop
+func (c *ProxyClient) Stop(ctx context.Context, session string) error {
+	_, err := do(ctx, c.HTTPClient, http.MethodPost, c.url("/stop", session), c.Token, nil, nil, c.Compress)
+	return err
+}
+
+// Check whether results were collected from all client pods, with /checkStopStatus
+func (c *ProxyClient) StopStatus(ctx context.Context, session string) (ProxyResponse, error) {
+	var status ProxyResponse
+	_, err := do(ctx, c.HTTPClient, http.MethodGet, c.url("/checkStopStatus", session), c.Token, nil, &status, c.Compress)
+	return status, err
+}
+
+// Retrieve the results of every client pod, from /results
+func (c *ProxyClient) Results(ctx context.Context, session string) (map[string][]ConnTest, error) {
+	var results map[string][]ConnTest
+	_, err := do(ctx, c.HTTPClient, http.MethodGet, c.url("/results", session), c.Token, nil, &results, c.Compress)
+	return results, err
+}
+
+// Retrieve the results of every client pod of an http workload session, from /results
+func (c *ProxyClient) ReachResults(ctx context.Context, session string) (map[string][]ReachResult, error) {
+	var results map[string][]ReachResult
+	_, err := do(ctx, c.HTTPClient, http.MethodGet, c.url("/results", session), c.Token, nil, &results, c.Compress)
+	return results, err
+}
+
+// Push a batch of results of a client pod, to /report
+func (c *ProxyClient) Report(ctx context.Context, report ResultsReport) (ReportResponse, error) {
+	var resp ReportResponse
+	_, err := do(ctx, c.HTTPClient, http.MethodPost, c.url("/report", ""), c.Token, report, &resp, c.Compress)
+	return resp, err
+}
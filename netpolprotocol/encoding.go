@@ -0,0 +1,143 @@
+package netpolprotocol
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Decompresses a gzip request body and closes the body with it
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// Return the body of r, decompressed when it is sent with Content-Encoding: gzip
+func RequestBody(r *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		return &gzipBody{Reader: reader, body: r.Body}, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q, use gzip", r.Header.Get("Content-Encoding"))
+}
+
+// Whether the client of r accepts gzip responses
+func acceptsGzip(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(accept, ";")
+		if strings.ToLower(strings.TrimSpace(coding)) != "gzip" {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// Compresses the response with gzip when the client accepts it. Close must be
+// called once the response is written. Flush sends what is written so far,
+// for responses streamed in chunks.
+type ResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func NewResponseWriter(w http.ResponseWriter, r *http.Request) *ResponseWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return &ResponseWriter{ResponseWriter: w}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	return &ResponseWriter{ResponseWriter: w, gz: gzip.NewWriter(w)}
+}
+
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+func (w *ResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *ResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// Decode a JSON array of results one result at a time, calling fn with
+// batches of up to batchSize results, so the whole array is never held in
+// memory. fn must not retain the batch.
+func DecodeResults(r io.Reader, batchSize int, fn func(batch []ConnTest) error) error {
+	return decodeArray(r, batchSize, fn)
+}
+
+// Decode a JSON array of HTTP reachability results as DecodeResults does
+func DecodeReachResults(r io.Reader, batchSize int, fn func(batch []ReachResult) error) error {
+	return decodeArray(r, batchSize, fn)
+}
+
+func decodeArray[T any](r io.Reader, batchSize int, fn func(batch []T) error) error {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to decode results: %v", err)
+	}
+	if token == nil {
+		// null, no results
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("failed to decode results: expected an array, got %v", token)
+	}
+	batch := make([]T, 0, batchSize)
+	for decoder.More() {
+		var res T
+		if err := decoder.Decode(&res); err != nil {
+			return fmt.Errorf("failed to decode results: %v", err)
+		}
+		batch = append(batch, res)
+		if len(batch) == batchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("failed to decode results: %v", err)
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+module example.com/netpolprotocol
+
+go 1.21.10
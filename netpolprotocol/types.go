@@ -0,0 +1,137 @@
+// Package netpolprotocol holds the types exchanged between kube-burner, the
+// netpolproxy pod and the netpolvalidator client pods, and clients of their
+// endpoints.
+package netpolprotocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Versions of the /initiate payload of the proxy:
+//   - 1: the connections of every client pod, {"<pod>": [Connection, ...]}
+//   - 2: InitiateRequest, the connections wrapped in an envelope declaring the
+//     schema version and, optionally, the network policies they may refer to
+const (
+	LegacySchemaVersion = 1
+	LatestSchemaVersion = 2
+)
+
+// Workload types of the proxy, selected with the workload query parameter of /initiate
+const (
+	// connections allowed by network policies, the default
+	WorkloadNetpol = "netpol"
+	// targets reached over HTTP, e.g. to measure service readiness
+	WorkloadHTTP = "http"
+)
+
+// Addresses and ports a client pod must reach once a network policy is applied
+type Connection struct {
+	Addresses []string `json:"addresses"`
+	Ports     []int32  `json:"ports"`
+	Netpol    string   `json:"netpol"`
+}
+
+// Result of a connection test: the time a client pod first reached an address
+// and port, by the clock of the client pod. IngressIdx is the index of the
+// connection in the list the client pod received. The proxy sets
+// CorrectedTimestamp to Timestamp by its own clock once it estimated the clock
+// offset of the client pod.
+type ConnTest struct {
+	Address            string     `json:"address"`
+	Port               int        `json:"port"`
+	IngressIdx         int        `json:"ingressidx"`
+	NpName             string     `json:"npname"`
+	Timestamp          time.Time  `json:"timestamp"`
+	CorrectedTimestamp *time.Time `json:"correctedTimestamp,omitempty"`
+}
+
+// Accept the connectionidx key used by client pods before this package
+// existed, which the proxy silently dropped
+func (c *ConnTest) UnmarshalJSON(data []byte) error {
+	type plain ConnTest
+	var v struct {
+		plain
+		ConnectionIdx *int `json:"connectionidx"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = ConnTest(v.plain)
+	if v.ConnectionIdx != nil && c.IngressIdx == 0 {
+		c.IngressIdx = *v.ConnectionIdx
+	}
+	return nil
+}
+
+// Result of an HTTP reachability test, the http workload counterpart of
+// ConnTest: the time a client pod first reached an address and port of a
+// target. TargetIdx is the index of the target in the list the client pod
+// received on /reach, Group the group of the target.
+type ReachResult struct {
+	Address            string     `json:"address"`
+	Port               int        `json:"port"`
+	TargetIdx          int        `json:"targetidx"`
+	Group              string     `json:"group"`
+	Timestamp          time.Time  `json:"timestamp"`
+	CorrectedTimestamp *time.Time `json:"correctedTimestamp,omitempty"`
+}
+
+// Reply of the /time endpoint of client pods, the current time by their clock
+type TimeResponse struct {
+	Time time.Time `json:"time"`
+}
+
+// Schema version 2 payload of /initiate. NetpolCreated holds the creation
+// time of network policies, readiness latencies are measured from it.
+type InitiateRequest struct {
+	SchemaVersion int                     `json:"schemaVersion"`
+	Netpols       []string                `json:"netpols,omitempty"`
+	NetpolCreated map[string]time.Time    `json:"netpolCreated,omitempty"`
+	Connections   map[string][]Connection `json:"connections"`
+}
+
+// Addresses and ports a client pod must reach over HTTP, reported under Group
+type Target struct {
+	Addresses []string `json:"addresses"`
+	Ports     []int32  `json:"ports"`
+	Group     string   `json:"group"`
+}
+
+// Payload of /initiate for the http workload: the targets of every client pod
+type ReachabilityRequest struct {
+	Targets map[string][]Target `json:"targets"`
+}
+
+// Reply of /checkConnectionsStatus and /checkStopStatus. Result is true once
+// the proxy is done with all client pods. Pods it gave up on are listed in
+// FailedPods, making it a partial success.
+type ProxyResponse struct {
+	Result     bool     `json:"result"`
+	Session    string   `json:"session,omitempty"`
+	Partial    bool     `json:"partial,omitempty"`
+	FailedPods []string `json:"failedPods,omitempty"`
+}
+
+// Batch of results pushed by a client pod to the proxy's /report, Results
+// for the netpol workload and Reached for the http workload. The final batch
+// tells the client pod has no more results to report.
+type ResultsReport struct {
+	Pod     string        `json:"pod"`
+	Session string        `json:"session,omitempty"`
+	Results []ConnTest    `json:"results"`
+	Reached []ReachResult `json:"reached,omitempty"`
+	Final   bool          `json:"final"`
+}
+
+// Reply of /report
+type ReportResponse struct {
+	Session  string `json:"session"`
+	Accepted int    `json:"accepted"`
+}
+
+// Returned by the proxy with 4xx status codes
+type ErrorResponse struct {
+	Error   string   `json:"error"`
+	Details []string `json:"details,omitempty"`
+}
@@ -0,0 +1,101 @@
+package netpolprotocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnTestLegacyConnectionIdx(t *testing.T) {
+	timestamp := time.Date(2024, 10, 1, 11, 18, 33, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    int
+	}{
+		{"ingressidx", `{"address":"10.0.0.1","port":8080,"ingressidx":3,"npname":"np1","timestamp":"2024-10-01T11:18:33Z"}`, 3},
+		{"legacy connectionidx", `{"address":"10.0.0.1","port":8080,"connectionidx":3,"npname":"np1","timestamp":"2024-10-01T11:18:33Z"}`, 3},
+		{"ingressidx takes precedence", `{"address":"10.0.0.1","port":8080,"ingressidx":3,"connectionidx":5,"npname":"np1","timestamp":"2024-10-01T11:18:33Z"}`, 3},
+		{"no index", `{"address":"10.0.0.1","port":8080,"npname":"np1","timestamp":"2024-10-01T11:18:33Z"}`, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var res ConnTest
+			if err := json.Unmarshal([]byte(tc.payload), &res); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			want := ConnTest{Address: "10.0.0.1", Port: 8080, IngressIdx: tc.want, NpName: "np1", Timestamp: timestamp}
+			if res.Address != want.Address || res.Port != want.Port || res.IngressIdx != want.IngressIdx || res.NpName != want.NpName || !res.Timestamp.Equal(want.Timestamp) {
+				t.Errorf("expected %+v, got %+v", want, res)
+			}
+		})
+	}
+}
+
+func TestConnTestRoundTrip(t *testing.T) {
+	corrected := time.Date(2024, 10, 1, 11, 18, 33, 500, time.UTC)
+	res := ConnTest{Address: "10.0.0.1", Port: 65535, IngressIdx: 2, NpName: "np1", Timestamp: corrected.Add(time.Second), CorrectedTimestamp: &corrected}
+	data, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if strings.Contains(string(data), "connectionidx") {
+		t.Errorf("expected only ingressidx to be sent, got %s", data)
+	}
+	var decoded ConnTest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if decoded.IngressIdx != 2 || decoded.Port != 65535 || decoded.CorrectedTimestamp == nil || !decoded.CorrectedTimestamp.Equal(corrected) {
+		t.Errorf("expected %+v, got %+v", res, decoded)
+	}
+}
+
+// Ports are int32 on connections and int on results, every valid port survives both
+func TestConnectionPorts(t *testing.T) {
+	var conn Connection
+	if err := json.Unmarshal([]byte(`{"addresses":["10.0.0.1"],"ports":[1,8080,65535],"netpol":"np1"}`), &conn); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(conn.Ports, []int32{1, 8080, 65535}) {
+		t.Fatalf("expected ports [1 8080 65535], got %v", conn.Ports)
+	}
+	// results carry the port of the connection they test
+	data, err := json.Marshal(ConnTest{Address: "10.0.0.1", Port: int(conn.Ports[2]), NpName: "np1"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var res ConnTest
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if res.Port != 65535 {
+		t.Errorf("expected port 65535 in results, got %d", res.Port)
+	}
+	if err := json.Unmarshal([]byte(`{"addresses":["10.0.0.1"],"ports":[4294967296],"netpol":"np1"}`), &conn); err == nil {
+		t.Error("expected a port out of the int32 range to be rejected")
+	}
+}
+
+func TestDecodeResultsLegacy(t *testing.T) {
+	payload := `[{"address":"10.0.0.1","port":8080,"connectionidx":1,"npname":"np1","timestamp":"2024-10-01T11:18:33Z"},` +
+		`{"address":"10.0.0.2","port":8080,"connectionidx":2,"npname":"np2","timestamp":"2024-10-01T11:18:34Z"},` +
+		`{"address":"10.0.0.3","port":8080,"connectionidx":3,"npname":"np3","timestamp":"2024-10-01T11:18:35Z"}]`
+	var batches [][]ConnTest
+	err := DecodeResults(strings.NewReader(payload), 2, func(batch []ConnTest) error {
+		batches = append(batches, append([]ConnTest(nil), batch...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("expected batches of 2 and 1 results, got %v", batches)
+	}
+	for i, res := range append(batches[0], batches[1]...) {
+		if res.IngressIdx != i+1 {
+			t.Errorf("result %d: expected ingressidx %d, got %d", i, i+1, res.IngressIdx)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Number of /time exchanges with every client pod, the one with the shortest
+// round trip gives the offset
+const defaultClockSamples = 4
+
+var clockSamples = defaultClockSamples
+
+// Estimated offset of the clock of a client pod from the clock of the proxy
+// pod: positive when the client pod is ahead. The error of the estimate is at
+// most half the round trip of the exchange it comes from.
+type clockOffset struct {
+	OffsetMs   float64   `json:"offsetMs"`
+	RTTMs      float64   `json:"rttMs"`
+	Samples    int       `json:"samples"`
+	MeasuredAt time.Time `json:"measuredAt"`
+}
+
+func (c *clockOffset) offset() time.Duration {
+	return time.Duration(c.OffsetMs * float64(time.Millisecond))
+}
+
+// Estimate the clock offset of pod NTP-style: the time of the client pod is
+// read at the middle of the round trip of the request
+func estimateClockOffset(ctx context.Context, pod string) (*clockOffset, error) {
+	var best *clockOffset
+	var lastErr error
+	samples := 0
+	for i := 0; i < clockSamples; i++ {
+		sent := time.Now()
+		podTime, err := podClient.Time(ctx, pod)
+		received := time.Now()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		samples++
+		rtt := received.Sub(sent)
+		offset := podTime.Sub(sent.Add(rtt / 2))
+		if best == nil || rtt < time.Duration(best.RTTMs*float64(time.Millisecond)) {
+			best = &clockOffset{
+				OffsetMs:   float64(offset) / float64(time.Millisecond),
+				RTTMs:      float64(rtt) / float64(time.Millisecond),
+				MeasuredAt: received.UTC(),
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("failed to read clock: %v", lastErr)
+	}
+	best.Samples = samples
+	return best, nil
+}
+
+// Estimate the clock offset of pod and correct the timestamps of its results.
+// Client pods without /time keep their raw timestamps.
+func (s *session) measureClock(pod string) {
+	if clockSamples == 0 {
+		return
+	}
+	clock, err := estimateClockOffset(context.Background(), pod)
+	if err != nil {
+		s.podLogger(pod).Warn("failed to estimate clock offset, keeping raw timestamps", "error", err)
+		return
+	}
+	s.podLogger(pod).Debug("clock offset estimated", "offsetMs", clock.OffsetMs, "rttMs", clock.RTTMs)
+	s.updatePodStatus(pod, func(ps *podStatus) {
+		ps.Clock = clock
+	})
+	s.mu.Lock()
+	s.correctTimestamps(pod)
+	s.mu.Unlock()
+}
+
+// Set the corrected timestamp of the results of pod from its clock offset,
+// callers hold s.mu
+func (s *session) correctTimestamps(pod string) {
+	ps, ok := s.podStatuses[pod]
+	if !ok || ps.Clock == nil {
+		return
+	}
+	offset := ps.Clock.offset()
+	for i := range s.clusterResults[pod] {
+		res := &s.clusterResults[pod][i]
+		corrected := res.Timestamp.Add(-offset).UTC()
+		res.CorrectedTimestamp = &corrected
+	}
+}
+
+// Timestamp of res by the clock of the proxy pod when known, by the clock of
+// the client pod otherwise
+func correctedTimestamp(res connTest) time.Time {
+	if res.CorrectedTimestamp != nil {
+		return *res.CorrectedTimestamp
+	}
+	return res.Timestamp
+}
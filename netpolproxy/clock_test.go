@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Client pod whose clock is ahead by skew. Its n-th /time request waits
+// delays[n] before reading the clock, as if the reply took that long to
+// come back.
+func newSkewedPod(t *testing.T, skew time.Duration, delays []time.Duration) *testPod {
+	var mu sync.Mutex
+	n := 0
+	p := &testPod{Server: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/time" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		delay := delays[n%len(delays)]
+		n++
+		mu.Unlock()
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(netpolprotocol.TimeResponse{Time: time.Now().Add(skew).UTC()})
+	}))}
+	t.Cleanup(p.Close)
+	return p
+}
+
+// The offset comes from the exchange with the shortest round trip: delayed
+// replies make the pod look further ahead by half their delay
+func TestEstimateClockOffset(t *testing.T) {
+	const skew = 3 * time.Second
+	delays := []time.Duration{80 * time.Millisecond, 60 * time.Millisecond, 0, 40 * time.Millisecond}
+	newTestProxy(t, map[string]*testPod{"pod-a": newSkewedPod(t, skew, delays)})
+
+	clock, err := estimateClockOffset(context.Background(), "pod-a")
+	if err != nil {
+		t.Fatalf("estimate: %v", err)
+	}
+	if clock.Samples != clockSamples {
+		t.Errorf("expected %d samples, got %d", clockSamples, clock.Samples)
+	}
+	if clock.RTTMs >= 40 {
+		t.Errorf("expected the round trip of the undelayed exchange, got %vms", clock.RTTMs)
+	}
+	if offset := clock.offset(); offset < skew-5*time.Millisecond || offset > skew+5*time.Millisecond {
+		t.Errorf("expected an offset of %v, got %v", skew, offset)
+	}
+}
+
+// Results of a pod are corrected by its offset, results of a pod whose clock
+// can't be read keep their raw timestamps
+func TestCorrectTimestamps(t *testing.T) {
+	const skew = -2 * time.Second
+	newTestProxy(t, map[string]*testPod{"pod-a": newSkewedPod(t, skew, []time.Duration{0})})
+	s := newSession("clock", defaultWorkload, nil)
+	reached := time.Date(2024, 10, 1, 11, 18, 33, 0, time.UTC)
+	s.clusterResults["pod-a"] = []connTest{
+		{Address: "10.0.0.1", Port: 8080, NpName: "np1", Timestamp: reached},
+		{Address: "10.0.0.1", Port: 8443, NpName: "np1", Timestamp: reached.Add(time.Second)},
+	}
+	s.clusterResults["pod-c"] = []connTest{{Address: "10.0.0.2", Port: 8080, NpName: "np1", Timestamp: reached}}
+
+	s.measureClock("pod-a")
+	s.measureClock("pod-c")
+	ps := s.podStatuses["pod-a"]
+	if ps == nil || ps.Clock == nil {
+		t.Fatalf("expected the clock of pod-a in its status, got %+v", ps)
+	}
+	offset := ps.Clock.offset()
+	if offset < skew-5*time.Millisecond || offset > skew+5*time.Millisecond {
+		t.Errorf("expected an offset of %v, got %v", skew, offset)
+	}
+	for i, res := range s.clusterResults["pod-a"] {
+		want := res.Timestamp.Add(-offset)
+		if res.CorrectedTimestamp == nil || !res.CorrectedTimestamp.Equal(want) {
+			t.Errorf("result %d: expected corrected timestamp %v, got %v", i, want, res.CorrectedTimestamp)
+		}
+		if got := correctedTimestamp(res); got.Sub(res.Timestamp) < 2*time.Second-5*time.Millisecond {
+			t.Errorf("result %d: expected the timestamp of a pod %v behind moved forward, got %v from %v", i, -skew, got, res.Timestamp)
+		}
+	}
+	if res := s.clusterResults["pod-c"][0]; res.CorrectedTimestamp != nil || !correctedTimestamp(res).Equal(reached) {
+		t.Errorf("expected the raw timestamp of a pod without clock, got %+v", res)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+const (
+	podPortEnvKey             = "POD_PORT"
+	listenPortEnvKey          = "LISTEN_PORT"
+	parallelConnectionsEnvKey = "PARALLEL_CONNECTIONS"
+	requestTimeoutEnvKey      = "REQUEST_TIMEOUT"
+	collectionDeadlineEnvKey  = "COLLECTION_DEADLINE"
+	maxRetriesEnvKey          = "MAX_RETRIES"
+	clockSamplesEnvKey        = "CLOCK_SAMPLES"
+	logLevelEnvKey            = "LOG_LEVEL"
+	shutdownTimeoutEnvKey     = "SHUTDOWN_TIMEOUT"
+	logFormatEnvKey           = "LOG_FORMAT"
+	stateFileEnvKey           = "STATE_FILE"
+	maxSessionsEnvKey         = "MAX_SESSIONS"
+	tlsCertFileEnvKey         = "TLS_CERT_FILE"
+	tlsKeyFileEnvKey          = "TLS_KEY_FILE"
+	authTokenFileEnvKey       = "AUTH_TOKEN_FILE"
+	podTLSEnvKey              = "POD_TLS"
+	podCAFileEnvKey           = "POD_CA_FILE"
+	podTLSInsecureEnvKey      = "POD_TLS_INSECURE_SKIP_VERIFY"
+	pollIntervalEnvKey        = "POLL_INTERVAL"
+	resultsModeEnvKey         = "RESULTS_MODE"
+	reportWaitEnvKey          = "REPORT_WAIT"
+	podResolverEnvKey         = "POD_RESOLVER"
+	podDNSSuffixEnvKey        = "POD_DNS_SUFFIX"
+	podSRVNameEnvKey          = "POD_SRV_NAME"
+	fanOutStrategyEnvKey      = "FANOUT_STRATEGY"
+	fanOutRateEnvKey          = "FANOUT_RATE"
+	fanOutBurstEnvKey         = "FANOUT_BURST"
+	fanOutWaveSizeEnvKey      = "FANOUT_WAVE_SIZE"
+	fanOutWaveDelayEnvKey     = "FANOUT_WAVE_DELAY"
+	simulatePodsEnvKey        = "SIMULATE_PODS"
+	simulateReadyEnvKey       = "SIMULATE_READY_LATENCY"
+	simulateRequestEnvKey     = "SIMULATE_REQUEST_LATENCY"
+	simulateFailureEnvKey     = "SIMULATE_FAILURE_RATE"
+	simulateUnreachableEnvKey = "SIMULATE_UNREACHABLE_RATE"
+	simulateClockSkewEnvKey   = "SIMULATE_CLOCK_SKEW"
+	simulateSeedEnvKey        = "SIMULATE_SEED"
+
+	defaultPodPort             = 9001
+	defaultListenPort          = 9002
+	defaultParallelConnections = 20
+	defaultRequestTimeout      = 10 * time.Second
+)
+
+var (
+	podPort             = defaultPodPort
+	listenPort          = defaultListenPort
+	parallelConnections = defaultParallelConnections
+	requestTimeout      = defaultRequestTimeout
+	// collection stops after this duration, 0 means no deadline
+	collectionDeadline time.Duration
+	// partial results are pulled from client pods at this interval until /stop, 0 disables polling
+	pollInterval time.Duration
+	// client used to talk to client pods
+	podClient = &netpolprotocol.PodClient{
+		HTTPClient: &http.Client{Timeout: defaultRequestTimeout},
+		Scheme:     "http",
+		Port:       defaultPodPort,
+	}
+	// certificate and key of the proxy server, it serves plain HTTP when unset
+	tlsCertFile string
+	tlsKeyFile  string
+)
+
+func envString(key, def string) string {
+	if str := os.Getenv(key); str != "" {
+		return str
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	str := os.Getenv(key)
+	if str == "" {
+		return def
+	}
+	v, err := strconv.Atoi(str)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse env %s: %v", key, err))
+	}
+	return v
+}
+
+func envFloat(key string, def float64) float64 {
+	str := os.Getenv(key)
+	if str == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse env %s: %v", key, err))
+	}
+	return v
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	str := os.Getenv(key)
+	if str == "" {
+		return def
+	}
+	v, err := time.ParseDuration(str)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse env %s: %v", key, err))
+	}
+	return v
+}
+
+func envBool(key string, def bool) bool {
+	str := os.Getenv(key)
+	if str == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(str)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse env %s: %v", key, err))
+	}
+	return v
+}
+
+// Read the configuration from flags, which default to the env vars, which
+// default to the historical constants of the proxy.
+func processEnvVars() {
+	var stateFile, authTokenFile, podCAFile, podResolver, podDNSSuffix, podSRVName string
+	var podTLS, podTLSInsecure bool
+	var simulateReady, simulateRequest, simulateSkew string
+	var level string
+	flag.IntVar(&podPort, "pod-port", envInt(podPortEnvKey, defaultPodPort), "port client pods listen on, env "+podPortEnvKey)
+	flag.IntVar(&listenPort, "listen-port", envInt(listenPortEnvKey, defaultListenPort), "port the proxy listens on, env "+listenPortEnvKey)
+	flag.IntVar(&parallelConnections, "parallel-connections", envInt(parallelConnectionsEnvKey, defaultParallelConnections), "number of client pods talked to in parallel, env "+parallelConnectionsEnvKey)
+	flag.StringVar(&fanOutStrategy, "fanout-strategy", envString(fanOutStrategyEnvKey, fanOutConcurrency), "how requests to client pods are paced: concurrency, rate or waves, env "+fanOutStrategyEnvKey)
+	flag.Float64Var(&fanOutRateLimit, "fanout-rate", envFloat(fanOutRateEnvKey, defaultFanOutRate), "requests per second with the rate strategy, env "+fanOutRateEnvKey)
+	flag.IntVar(&fanOutBurst, "fanout-burst", envInt(fanOutBurstEnvKey, defaultFanOutBurst), "requests started at once with the rate strategy, env "+fanOutBurstEnvKey)
+	flag.IntVar(&fanOutWaveSize, "fanout-wave-size", envInt(fanOutWaveSizeEnvKey, defaultFanOutWaveSize), "requests per wave with the waves strategy, env "+fanOutWaveSizeEnvKey)
+	flag.DurationVar(&fanOutWaveDelay, "fanout-wave-delay", envDuration(fanOutWaveDelayEnvKey, defaultFanOutWaveDelay), "delay between waves with the waves strategy, env "+fanOutWaveDelayEnvKey)
+	flag.DurationVar(&requestTimeout, "request-timeout", envDuration(requestTimeoutEnvKey, defaultRequestTimeout), "timeout of every request to a client pod, env "+requestTimeoutEnvKey)
+	flag.DurationVar(&collectionDeadline, "collection-deadline", envDuration(collectionDeadlineEnvKey, 0), "time after /stop to give up on collecting results, 0 for no deadline, env "+collectionDeadlineEnvKey)
+	flag.DurationVar(&pollInterval, "poll-interval", envDuration(pollIntervalEnvKey, 0), "interval to pull partial results from client pods at until /stop, 0 to disable, env "+pollIntervalEnvKey)
+	flag.StringVar(&podResolver, "pod-resolver", envString(podResolverEnvKey, resolverDirect), "how pod keys map to client pods: direct, dns or srv, env "+podResolverEnvKey)
+	flag.StringVar(&podDNSSuffix, "pod-dns-suffix", os.Getenv(podDNSSuffixEnvKey), "domain appended to pod names with the dns resolver, env "+podDNSSuffixEnvKey)
+	flag.StringVar(&podSRVName, "pod-srv-name", os.Getenv(podSRVNameEnvKey), "SRV record listing client pods with the srv resolver, env "+podSRVNameEnvKey)
+	flag.StringVar(&resultsMode, "results-mode", envString(resultsModeEnvKey, resultsModePull), "pull results from client pods after /stop or wait for them to push them, env "+resultsModeEnvKey)
+	flag.DurationVar(&reportWait, "report-wait", envDuration(reportWaitEnvKey, defaultReportWait), "time after /stop to wait for client pods to push their final results in push mode before pulling them, env "+reportWaitEnvKey)
+	flag.IntVar(&maxRetries, "max-retries", envInt(maxRetriesEnvKey, defaultMaxRetries), "retries per client pod request, env "+maxRetriesEnvKey)
+	flag.IntVar(&clockSamples, "clock-samples", envInt(clockSamplesEnvKey, defaultClockSamples), "/time exchanges to estimate the clock offset of every client pod with, 0 to disable, env "+clockSamplesEnvKey)
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", envDuration(shutdownTimeoutEnvKey, defaultShutdownTimeout), "time to finish the phase in progress on SIGTERM before checkpointing it, plus the report wait in push mode by default, env "+shutdownTimeoutEnvKey)
+	flag.IntVar(&maxSessions, "max-sessions", envInt(maxSessionsEnvKey, defaultMaxSessions), "sessions kept, the oldest completed ones are dropped past it, 0 keeps them all, env "+maxSessionsEnvKey)
+	flag.StringVar(&stateFile, "state-file", os.Getenv(stateFileEnvKey), "file to persist the state to, env "+stateFileEnvKey)
+	flag.StringVar(&tlsCertFile, "tls-cert-file", os.Getenv(tlsCertFileEnvKey), "certificate to serve HTTPS with, env "+tlsCertFileEnvKey)
+	flag.StringVar(&tlsKeyFile, "tls-key-file", os.Getenv(tlsKeyFileEnvKey), "key of the certificate to serve HTTPS with, env "+tlsKeyFileEnvKey)
+	flag.StringVar(&authTokenFile, "auth-token-file", os.Getenv(authTokenFileEnvKey), "file holding the bearer token required on control endpoints, env "+authTokenFileEnvKey)
+	flag.BoolVar(&podTLS, "pod-tls", envBool(podTLSEnvKey, false), "talk to client pods over HTTPS, env "+podTLSEnvKey)
+	flag.StringVar(&podCAFile, "pod-ca-file", os.Getenv(podCAFileEnvKey), "CA bundle to verify client pods with, system roots by default, env "+podCAFileEnvKey)
+	flag.BoolVar(&podTLSInsecure, "pod-tls-insecure-skip-verify", envBool(podTLSInsecureEnvKey, false), "don't verify client pod certificates, env "+podTLSInsecureEnvKey)
+	flag.IntVar(&simulatePods, "simulate-pods", envInt(simulatePodsEnvKey, 0), "number of in-process fake client pods to talk to instead of real ones, 0 to disable, env "+simulatePodsEnvKey)
+	flag.StringVar(&simulateReady, "simulate-ready-latency", envString(simulateReadyEnvKey, simulateReadyLatency.String()), "time until fake client pods reach a connection, env "+simulateReadyEnvKey)
+	flag.StringVar(&simulateRequest, "simulate-request-latency", envString(simulateRequestEnvKey, simulateRequestLatency.String()), "response time of fake client pods, env "+simulateRequestEnvKey)
+	flag.Float64Var(&simulateFailureRate, "simulate-failure-rate", envFloat(simulateFailureEnvKey, 0), "fraction of requests fake client pods fail, env "+simulateFailureEnvKey)
+	flag.Float64Var(&simulateUnreachable, "simulate-unreachable-rate", envFloat(simulateUnreachableEnvKey, 0), "fraction of connections fake client pods never reach, env "+simulateUnreachableEnvKey)
+	flag.StringVar(&simulateSkew, "simulate-clock-skew", envString(simulateClockSkewEnvKey, simulateClockSkew.String()), "clock offset of fake client pods, env "+simulateClockSkewEnvKey)
+	flag.Int64Var(&simulateSeed, "simulate-seed", int64(envInt(simulateSeedEnvKey, 0)), "seed of the random draws of fake client pods, 0 seeds from the current time, env "+simulateSeedEnvKey)
+	flag.StringVar(&level, "log-level", envString(logLevelEnvKey, "info"), "log level: debug, info, warn or error, env "+logLevelEnvKey)
+	flag.StringVar(&logFormat, "log-format", envString(logFormatEnvKey, logFormatJSON), "log format: json or text, env "+logFormatEnvKey)
+	flag.Parse()
+
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		panic(fmt.Sprintf("invalid log level: %v", err))
+	}
+	if err := setupLogging(os.Stderr, logFormat); err != nil {
+		panic(fmt.Sprintf("invalid log format: %v", err))
+	}
+	if podPort <= 0 || podPort > 65535 || listenPort <= 0 || listenPort > 65535 {
+		panic(fmt.Sprintf("invalid ports: pod port %d, listen port %d", podPort, listenPort))
+	}
+	if parallelConnections <= 0 {
+		panic(fmt.Sprintf("invalid parallel connections %d: positive integer required", parallelConnections))
+	}
+	if resultsMode != resultsModePull && resultsMode != resultsModePush {
+		panic(fmt.Sprintf("invalid results mode %q: %s or %s required", resultsMode, resultsModePull, resultsModePush))
+	}
+	if err := validateFanOut(); err != nil {
+		panic(fmt.Sprintf("invalid fan-out: %v", err))
+	}
+	if maxRetries < 0 {
+		panic(fmt.Sprintf("invalid max retries %d: non-negative integer required", maxRetries))
+	}
+	if clockSamples < 0 {
+		panic(fmt.Sprintf("invalid clock samples %d: non-negative integer required", clockSamples))
+	}
+	if maxSessions < 0 {
+		panic(fmt.Sprintf("invalid max sessions %d: non-negative integer required", maxSessions))
+	}
+	shutdownTimeoutSet := os.Getenv(shutdownTimeoutEnvKey) != ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "shutdown-timeout" {
+			shutdownTimeoutSet = true
+		}
+	})
+	if !shutdownTimeoutSet {
+		shutdownTimeout = defaultShutdownTimeoutFor(resultsMode, reportWait)
+	}
+	if shutdownTimeout < 0 {
+		panic(fmt.Sprintf("invalid shutdown timeout %v: non-negative duration required", shutdownTimeout))
+	}
+	if resultsMode == resultsModePush && reportWait > 0 && shutdownTimeout <= reportWait {
+		slog.Warn("shutdown timeout doesn't cover the report wait, a session collecting results on shutdown is checkpointed before pulling the results of pods which didn't push them",
+			"shutdownTimeout", shutdownTimeout.String(), "reportWait", reportWait.String())
+	}
+	if requestTimeout <= 0 || collectionDeadline < 0 || pollInterval < 0 || reportWait < 0 {
+		panic(fmt.Sprintf("invalid request timeout %v, collection deadline %v, poll interval %v or report wait %v", requestTimeout, collectionDeadline, pollInterval, reportWait))
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		panic(fmt.Sprintf("both %s and %s are required to serve HTTPS", tlsCertFileEnvKey, tlsKeyFileEnvKey))
+	}
+	if authTokenFile != "" {
+		var err error
+		if authToken, err = loadToken(authTokenFile); err != nil {
+			panic(fmt.Sprintf("failed to read auth token: %v", err))
+		}
+	}
+	podClient = &netpolprotocol.PodClient{
+		HTTPClient: &http.Client{Timeout: requestTimeout},
+		Scheme:     "http",
+		Port:       podPort,
+	}
+	resolver, err := newPodResolver(podResolver, podDNSSuffix, podSRVName)
+	if err != nil {
+		panic(fmt.Sprintf("invalid pod resolver: %v", err))
+	}
+	podClient.Resolver = resolver
+	if simulatePods < 0 || simulateFailureRate < 0 || simulateFailureRate > 1 || simulateUnreachable < 0 || simulateUnreachable > 1 {
+		panic(fmt.Sprintf("invalid simulation: %d pods, failure rate %v, unreachable rate %v", simulatePods, simulateFailureRate, simulateUnreachable))
+	}
+	if simulateReadyLatency, err = parseDistribution(simulateReady); err != nil {
+		panic(fmt.Sprintf("invalid simulated ready latency: %v", err))
+	}
+	if simulateRequestLatency, err = parseDistribution(simulateRequest); err != nil {
+		panic(fmt.Sprintf("invalid simulated request latency: %v", err))
+	}
+	if simulateClockSkew, err = parseDistribution(simulateSkew); err != nil {
+		panic(fmt.Sprintf("invalid simulated clock skew: %v", err))
+	}
+	if simulatePods > 0 && (podTLS || podResolver != resolverDirect) {
+		panic("simulated client pods are reached over plain HTTP with the direct resolver")
+	}
+	if podTLS {
+		tlsConfig, err := podTLSConfig(podCAFile, podTLSInsecure)
+		if err != nil {
+			panic(fmt.Sprintf("failed to configure TLS to client pods: %v", err))
+		}
+		podClient.Scheme = "https"
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		podClient.HTTPClient.Transport = transport
+	}
+	// Enable persistence when a state file is set, it should be on a volume
+	// which outlives the proxy pod
+	if stateFile != "" {
+		store = newStateStore(stateFile)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of /results, selected with the format query parameter or the Accept header
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+
+	// rows written between two flushes of a streamed response
+	exportFlushRows = 1000
+	// results decoded at once when retrieving them from a client pod
+	resultsBatchSize = 1000
+)
+
+var (
+	formatContentTypes = map[string]string{
+		formatJSON:   "application/json",
+		formatNDJSON: "application/x-ndjson",
+		formatCSV:    "text/csv; charset=utf-8",
+	}
+)
+
+// A single connection test result of a client pod, one line of NDJSON and CSV exports
+type resultRow struct {
+	Pod string `json:"pod,omitempty"`
+	connTest
+}
+
+// Restricts exported results to some client pods and groups, e.g. network
+// policies, an empty set matches everything
+type resultsFilter struct {
+	pods   map[string]bool
+	groups map[string]bool
+}
+
+// Filter of the pod query parameter and of the group parameter of the
+// workload type of the session, e.g. netpol
+func (s *session) resultsFilter(r *http.Request) resultsFilter {
+	toSet := func(values []string) map[string]bool {
+		set := make(map[string]bool)
+		for _, v := range values {
+			for _, item := range strings.Split(v, ",") {
+				if item != "" {
+					set[item] = true
+				}
+			}
+		}
+		return set
+	}
+	query := r.URL.Query()
+	return resultsFilter{pods: toSet(query["pod"]), groups: toSet(query[s.workloadType().grouping().column])}
+}
+
+func (f resultsFilter) matchPod(pod string) bool {
+	return len(f.pods) == 0 || f.pods[pod]
+}
+
+func (f resultsFilter) matchResult(res connTest) bool {
+	return len(f.groups) == 0 || f.groups[res.NpName]
+}
+
+// Pick the export format from the format query parameter, then from the Accept header
+func resultsFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported format %q, use %s, %s or %s", format, formatJSON, formatNDJSON, formatCSV)
+		}
+		return format, nil
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/x-ndjson", "application/ndjson":
+			return formatNDJSON, nil
+		case "text/csv":
+			return formatCSV, nil
+		case "application/json":
+			return formatJSON, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+// Return the client pods which returned results, sorted
+func (s *session) podsWithResults() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pods := make([]string, 0, len(s.clusterResults))
+	for pod := range s.clusterResults {
+		pods = append(pods, pod)
+	}
+	sort.Strings(pods)
+	return pods
+}
+
+// Return a copy of the results of pod
+func (s *session) podResults(pod string) []connTest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]connTest(nil), s.clusterResults[pod]...)
+}
+
+// Write the results of the session matching filter one row at a time. The
+// session lock is only held while copying the results of one pod, so large
+// sessions are neither buffered nor block the collection.
+func (s *session) streamResults(w http.ResponseWriter, format string, filter resultsFilter) error {
+	wt := s.workloadType()
+	var writeRow func(row resultRow) error
+	var flush func() error
+	switch format {
+	case formatNDJSON:
+		encoder := json.NewEncoder(w)
+		writeRow = func(row resultRow) error { return encoder.Encode(wt.encodeResult(row.Pod, row.connTest)) }
+		flush = func() error { return nil }
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		grouping := wt.grouping()
+		header := []string{"pod", "address", "port", grouping.index, grouping.column, "timestamp", "correctedtimestamp"}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		writeRow = func(row resultRow) error {
+			return writer.Write([]string{
+				row.Pod,
+				row.Address,
+				strconv.Itoa(row.Port),
+				strconv.Itoa(row.IngressIdx),
+				row.NpName,
+				row.Timestamp.Format(time.RFC3339Nano),
+				correctedTimestamp(row.connTest).Format(time.RFC3339Nano),
+			})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return fmt.Errorf("format %q cannot be streamed", format)
+	}
+	flusher, _ := w.(http.Flusher)
+	rows := 0
+	for _, pod := range s.podsWithResults() {
+		if !filter.matchPod(pod) {
+			continue
+		}
+		for _, res := range s.podResults(pod) {
+			if !filter.matchResult(res) {
+				continue
+			}
+			if err := writeRow(resultRow{Pod: pod, connTest: res}); err != nil {
+				return err
+			}
+			rows++
+			if rows%exportFlushRows == 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	}
+	return flush()
+}
+
+// Write the results of the session matching filter as a single JSON object
+// keyed by client pod, the historical /results format. Like streamResults,
+// results are written one at a time and flushed every exportFlushRows
+// results. Without filter, pods which returned no results are listed with an
+// empty list.
+func (s *session) writeResultsJSON(w io.Writer, filter resultsFilter) error {
+	wt := s.workloadType()
+	unfiltered := len(filter.pods) == 0 && len(filter.groups) == 0
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('{')
+	pods, rows := 0, 0
+	writeKey := func(pod string) {
+		if pods > 0 {
+			bw.WriteByte(',')
+		}
+		key, _ := json.Marshal(pod)
+		bw.Write(key)
+		bw.WriteString(":[")
+		pods++
+	}
+	for _, pod := range s.podsWithResults() {
+		if !filter.matchPod(pod) {
+			continue
+		}
+		written := 0
+		for _, res := range s.podResults(pod) {
+			if !filter.matchResult(res) {
+				continue
+			}
+			if written == 0 {
+				writeKey(pod)
+			} else {
+				bw.WriteByte(',')
+			}
+			data, err := json.Marshal(wt.encodeResult("", res))
+			if err != nil {
+				return err
+			}
+			bw.Write(data)
+			written++
+			rows++
+			if rows%exportFlushRows == 0 {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+		if written == 0 && unfiltered {
+			writeKey(pod)
+		}
+		if written > 0 || unfiltered {
+			bw.WriteByte(']')
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
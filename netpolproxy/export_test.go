@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Session with results of pod-a for np1 and np2 and of pod-b for np1, pod-c
+// returned none
+func newExportSession() *session {
+	s := newSession("export", defaultWorkload, nil)
+	reached := time.Date(2024, 10, 1, 11, 18, 33, 0, time.UTC)
+	corrected := reached.Add(-time.Second)
+	s.clusterResults["pod-a"] = []connTest{
+		{Address: "10.0.0.1", Port: 8080, IngressIdx: 0, NpName: "np1", Timestamp: reached, CorrectedTimestamp: &corrected},
+		{Address: "10.0.0.2", Port: 8443, IngressIdx: 1, NpName: "np2", Timestamp: reached},
+	}
+	s.clusterResults["pod-b"] = []connTest{{Address: "10.0.0.1", Port: 8080, IngressIdx: 0, NpName: "np1", Timestamp: reached}}
+	s.clusterResults["pod-c"] = nil
+	return s
+}
+
+func TestResultsFilter(t *testing.T) {
+	s := newExportSession()
+	r := httptest.NewRequest("GET", "/results?pod=pod-a,pod-c&pod=pod-d&netpol=np2", nil)
+	filter := s.resultsFilter(r)
+	want := resultsFilter{
+		pods:   map[string]bool{"pod-a": true, "pod-c": true, "pod-d": true},
+		groups: map[string]bool{"np2": true},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("expected %+v, got %+v", want, filter)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter resultsFilter
+		want   [][]string
+	}{
+		{"unfiltered", resultsFilter{}, [][]string{
+			{"pod-a", "10.0.0.1", "8080", "0", "np1", "2024-10-01T11:18:33Z", "2024-10-01T11:18:32Z"},
+			{"pod-a", "10.0.0.2", "8443", "1", "np2", "2024-10-01T11:18:33Z", "2024-10-01T11:18:33Z"},
+			{"pod-b", "10.0.0.1", "8080", "0", "np1", "2024-10-01T11:18:33Z", "2024-10-01T11:18:33Z"},
+		}},
+		{"pod", resultsFilter{pods: map[string]bool{"pod-b": true}}, [][]string{
+			{"pod-b", "10.0.0.1", "8080", "0", "np1", "2024-10-01T11:18:33Z", "2024-10-01T11:18:33Z"},
+		}},
+		{"netpol", resultsFilter{groups: map[string]bool{"np2": true}}, [][]string{
+			{"pod-a", "10.0.0.2", "8443", "1", "np2", "2024-10-01T11:18:33Z", "2024-10-01T11:18:33Z"},
+		}},
+		{"pod and netpol", resultsFilter{pods: map[string]bool{"pod-b": true}, groups: map[string]bool{"np2": true}}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := newExportSession().streamResults(w, formatCSV, tc.filter); err != nil {
+				t.Fatalf("export: %v", err)
+			}
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil {
+				t.Fatalf("decode csv: %v", err)
+			}
+			header := []string{"pod", "address", "port", "ingressidx", "netpol", "timestamp", "correctedtimestamp"}
+			if len(rows) == 0 || !reflect.DeepEqual(rows[0], header) {
+				t.Fatalf("expected header %v, got %v", header, rows)
+			}
+			if !reflect.DeepEqual(rows[1:], append([][]string{}, tc.want...)) {
+				t.Errorf("expected rows %v, got %v", tc.want, rows[1:])
+			}
+		})
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter resultsFilter
+		want   []string
+	}{
+		{"unfiltered", resultsFilter{}, []string{"pod-a/np1", "pod-a/np2", "pod-b/np1"}},
+		{"pod", resultsFilter{pods: map[string]bool{"pod-a": true}}, []string{"pod-a/np1", "pod-a/np2"}},
+		{"netpol", resultsFilter{groups: map[string]bool{"np1": true}}, []string{"pod-a/np1", "pod-b/np1"}},
+		{"unknown pod", resultsFilter{pods: map[string]bool{"pod-d": true}}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := newExportSession().streamResults(w, formatNDJSON, tc.filter); err != nil {
+				t.Fatalf("export: %v", err)
+			}
+			var got []string
+			scanner := bufio.NewScanner(w.Body)
+			for scanner.Scan() {
+				// connTest decodes itself, the pod is decoded apart
+				var row struct {
+					Pod string `json:"pod"`
+				}
+				var res connTest
+				if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+					t.Fatalf("decode %s: %v", scanner.Text(), err)
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+					t.Fatalf("decode %s: %v", scanner.Text(), err)
+				}
+				if res.Address == "" || res.Timestamp.IsZero() {
+					t.Errorf("expected a complete row, got %s", scanner.Text())
+				}
+				got = append(got, row.Pod+"/"+res.NpName)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected rows %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// The JSON export lists pods without results only when unfiltered
+func TestExportJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter resultsFilter
+		want   map[string]int
+	}{
+		{"unfiltered", resultsFilter{}, map[string]int{"pod-a": 2, "pod-b": 1, "pod-c": 0}},
+		{"netpol", resultsFilter{groups: map[string]bool{"np1": true}}, map[string]int{"pod-a": 1, "pod-b": 1}},
+		{"pod", resultsFilter{pods: map[string]bool{"pod-c": true}}, map[string]int{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := newExportSession().writeResultsJSON(w, tc.filter); err != nil {
+				t.Fatalf("export: %v", err)
+			}
+			var results map[string][]connTest
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatalf("decode %s: %v", w.Body, err)
+			}
+			got := make(map[string]int)
+			for pod, res := range results {
+				got[pod] = len(res)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected results per pod %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestResultsFormat(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		accept string
+		want   string
+	}{
+		{"", "", formatJSON},
+		{"?format=csv", "application/x-ndjson", formatCSV},
+		{"", "text/html, application/ndjson;q=0.9", formatNDJSON},
+		{"", "text/csv; charset=utf-8", formatCSV},
+	} {
+		r := httptest.NewRequest("GET", "/results"+tc.query, nil)
+		r.Header.Set("Accept", tc.accept)
+		if format, err := resultsFormat(r); err != nil || format != tc.want {
+			t.Errorf("%q, Accept %q: expected %s, got %s, %v", tc.query, tc.accept, tc.want, format, err)
+		}
+	}
+	if _, err := resultsFormat(httptest.NewRequest("GET", "/results?format=xml", nil)); err == nil {
+		t.Error("expected an unsupported format to be rejected")
+	}
+}
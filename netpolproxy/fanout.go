@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How requests to client pods are spread over time
+const (
+	// up to parallelConnections requests at once, started as fast as possible
+	fanOutConcurrency = "concurrency"
+	// as fanOutConcurrency, started at fanOutRate per second with bursts of fanOutBurst
+	fanOutRate = "rate"
+	// waves of fanOutWaveSize requests, each wave starts fanOutWaveDelay after the previous one completed
+	fanOutWaves = "waves"
+
+	defaultFanOutRate      = 50
+	defaultFanOutBurst     = 10
+	defaultFanOutWaveSize  = 100
+	defaultFanOutWaveDelay = 5 * time.Second
+)
+
+var (
+	fanOutStrategy  = fanOutConcurrency
+	fanOutRateLimit = float64(defaultFanOutRate)
+	fanOutBurst     = defaultFanOutBurst
+	fanOutWaveSize  = defaultFanOutWaveSize
+	fanOutWaveDelay = defaultFanOutWaveDelay
+)
+
+// Token bucket refilled at rate tokens per second, holding up to burst tokens
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Take a token, waiting for one to be available or for ctx to be done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Paces the requests of one phase, delivery, collection or polling, to
+// client pods according to fanOutStrategy. acquire is called by a single
+// goroutine before starting a request, release once the request is done.
+type fanOut struct {
+	phase     string
+	semaphore chan struct{}
+	bucket    *tokenBucket
+	waveSize  int
+	inWave    int
+	started   int
+	start     time.Time
+
+	mu sync.Mutex
+	// requests of the current wave in flight, waveDone is closed once they are done
+	waveInFlight int
+	waveDone     chan struct{}
+}
+
+func newFanOut(phase string) *fanOut {
+	f := &fanOut{
+		phase:     phase,
+		semaphore: make(chan struct{}, parallelConnections),
+		start:     time.Now(),
+	}
+	switch fanOutStrategy {
+	case fanOutRate:
+		f.bucket = newTokenBucket(fanOutRateLimit, fanOutBurst)
+	case fanOutWaves:
+		f.waveSize = fanOutWaveSize
+	}
+	return f
+}
+
+// Wait until the next request may start, or ctx is done
+func (f *fanOut) acquire(ctx context.Context) error {
+	if f.waveSize > 0 && f.inWave == f.waveSize {
+		f.mu.Lock()
+		waveDone := f.waveDone
+		f.mu.Unlock()
+		select {
+		case <-waveDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-time.After(fanOutWaveDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		f.inWave = 0
+	}
+	if f.bucket != nil {
+		if err := f.bucket.wait(ctx); err != nil {
+			return err
+		}
+	}
+	select {
+	case f.semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	f.inWave++
+	f.mu.Lock()
+	if f.waveInFlight == 0 {
+		f.waveDone = make(chan struct{})
+	}
+	f.waveInFlight++
+	f.mu.Unlock()
+	f.started++
+	fanOutStarted.WithLabelValues(f.phase).Inc()
+	fanOutInFlight.WithLabelValues(f.phase).Inc()
+	fanOutAchievedRate.WithLabelValues(f.phase).Set(f.rate())
+	return nil
+}
+
+func (f *fanOut) release() {
+	fanOutInFlight.WithLabelValues(f.phase).Dec()
+	f.mu.Lock()
+	f.waveInFlight--
+	if f.waveInFlight == 0 {
+		close(f.waveDone)
+	}
+	f.mu.Unlock()
+	<-f.semaphore
+}
+
+// Requests started per second since the fan-out started
+func (f *fanOut) rate() float64 {
+	elapsed := time.Since(f.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(f.started) / elapsed
+}
+
+// Log the achieved rate, once all requests are done
+func (f *fanOut) finish(session string) {
+	if f.started == 0 {
+		return
+	}
+	rate := f.rate()
+	fanOutAchievedRate.WithLabelValues(f.phase).Set(rate)
+	slog.Info("fan-out finished", "session", session, "phase", f.phase, "pods", f.started,
+		"duration", time.Since(f.start).Round(time.Millisecond).String(), "strategy", fanOutStrategy, "podsPerSecond", rate)
+}
+
+func validateFanOut() error {
+	switch fanOutStrategy {
+	case fanOutConcurrency:
+	case fanOutRate:
+		if fanOutRateLimit <= 0 || fanOutBurst <= 0 {
+			return fmt.Errorf("positive rate and burst required, got %v and %d", fanOutRateLimit, fanOutBurst)
+		}
+	case fanOutWaves:
+		if fanOutWaveSize <= 0 || fanOutWaveDelay < 0 {
+			return fmt.Errorf("positive wave size and non-negative wave delay required, got %d and %v", fanOutWaveSize, fanOutWaveDelay)
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q, use %s, %s or %s", fanOutStrategy, fanOutConcurrency, fanOutRate, fanOutWaves)
+	}
+	return nil
+}
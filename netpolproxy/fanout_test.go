@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Use strategy with its settings for the duration of the test
+func useFanOut(t *testing.T, strategy string, rate float64, burst, waveSize int, waveDelay time.Duration) {
+	fanOutStrategy, fanOutRateLimit, fanOutBurst, fanOutWaveSize, fanOutWaveDelay = strategy, rate, burst, waveSize, waveDelay
+	t.Cleanup(func() {
+		fanOutStrategy, fanOutRateLimit, fanOutBurst = fanOutConcurrency, defaultFanOutRate, defaultFanOutBurst
+		fanOutWaveSize, fanOutWaveDelay = defaultFanOutWaveSize, defaultFanOutWaveDelay
+	})
+}
+
+// Start n requests lasting duration through f, returning when each of them started
+func runFanOut(t *testing.T, f *fanOut, n int, duration time.Duration) []time.Time {
+	t.Helper()
+	var wg sync.WaitGroup
+	started := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		if err := f.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		started = append(started, time.Now())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer f.release()
+			time.Sleep(duration)
+		}()
+	}
+	wg.Wait()
+	return started
+}
+
+func TestFanOutRate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rate  float64
+		burst int
+		n     int
+	}{
+		{"no burst", 100, 1, 11},
+		{"burst", 100, 5, 15},
+		{"burst covers all", 100, 10, 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useFanOut(t, fanOutRate, tc.rate, tc.burst, 0, 0)
+			f := newFanOut("test")
+			started := runFanOut(t, f, tc.n, 0)
+
+			// the burst starts right away, the rest at rate
+			expected := time.Duration(float64(tc.n-tc.burst) / tc.rate * float64(time.Second))
+			elapsed := started[len(started)-1].Sub(started[0])
+			if elapsed < expected*9/10 || elapsed > expected+200*time.Millisecond {
+				t.Errorf("expected %d requests to start within %v, took %v", tc.n, expected, elapsed)
+			}
+			if f.started != tc.n {
+				t.Errorf("expected %d requests started, got %d", tc.n, f.started)
+			}
+			if tc.n > tc.burst {
+				maxRate := float64(tc.n) / expected.Seconds()
+				if rate := f.rate(); rate > maxRate*1.1 {
+					t.Errorf("expected an achieved rate up to %.1f/s, got %.1f/s", maxRate, rate)
+				}
+			}
+		})
+	}
+}
+
+func TestFanOutWaves(t *testing.T) {
+	const (
+		duration  = 20 * time.Millisecond
+		waveDelay = 50 * time.Millisecond
+	)
+	for _, tc := range []struct {
+		name     string
+		waveSize int
+		n        int
+		waves    []int
+	}{
+		{"partial last wave", 3, 7, []int{3, 3, 1}},
+		{"single wave", 5, 5, []int{5}},
+		{"one pod per wave", 1, 3, []int{1, 1, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useFanOut(t, fanOutWaves, 0, 0, tc.waveSize, waveDelay)
+			started := runFanOut(t, newFanOut("test"), tc.n, duration)
+
+			// a wave starts once the previous one completed and the delay passed
+			waves := []int{1}
+			for i := 1; i < len(started); i++ {
+				gap := started[i].Sub(started[i-1])
+				if gap >= duration+waveDelay {
+					waves = append(waves, 1)
+					continue
+				}
+				if gap > waveDelay/2 {
+					t.Fatalf("request %d started %v after the previous one, neither in the same wave nor the next", i, gap)
+				}
+				waves[len(waves)-1]++
+			}
+			if len(waves) != len(tc.waves) {
+				t.Fatalf("expected waves %v, got %v", tc.waves, waves)
+			}
+			for i := range waves {
+				if waves[i] != tc.waves[i] {
+					t.Errorf("expected waves %v, got %v", tc.waves, waves)
+					break
+				}
+			}
+		})
+	}
+}
+
+// A wave waiting for requests which never complete gives up with ctx,
+// without leaving a goroutine behind
+func TestFanOutWaveCancel(t *testing.T) {
+	useFanOut(t, fanOutWaves, 0, 0, 2, 0)
+	f := newFanOut("test")
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 2; i++ {
+		if err := f.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := f.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to end the wait for the wave, got %v", err)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("expected no goroutine left waiting for the wave, %d before and %d after", goroutines, n)
+	}
+	f.release()
+	f.release()
+	if err := f.acquire(context.Background()); err != nil {
+		t.Errorf("expected the next wave to start once the previous one completed, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Log output formats
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+var (
+	logFormat = logFormatJSON
+	// level of records which aren't about a pod with its own level
+	logLevel = new(slog.LevelVar)
+
+	podLogLevelsMu sync.RWMutex
+	// levels overriding logLevel for the records of some client pods
+	podLogLevels = make(map[string]slog.Level)
+)
+
+// Level of the records of pod
+func podLogLevel(pod string) slog.Level {
+	podLogLevelsMu.RLock()
+	defer podLogLevelsMu.RUnlock()
+	if level, ok := podLogLevels[pod]; ok {
+		return level
+	}
+	return logLevel.Level()
+}
+
+// Filters records by logLevel, or by the level of their client pod for
+// loggers returned by podLogger
+type levelHandler struct {
+	handler slog.Handler
+	pod     string
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.pod != "" {
+		return level >= podLogLevel(h.pod)
+	}
+	return level >= logLevel.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	pod := h.pod
+	for _, attr := range attrs {
+		if attr.Key == "pod" {
+			pod = attr.Value.String()
+		}
+	}
+	return &levelHandler{handler: h.handler.WithAttrs(attrs), pod: pod}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{handler: h.handler.WithGroup(name), pod: h.pod}
+}
+
+// Log records of format to w and make it the default logger, records of the
+// log package included
+func setupLogging(w io.Writer, format string) error {
+	// levels are filtered by levelHandler
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug - 4}
+	var handler slog.Handler
+	switch format {
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case logFormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, use %s or %s", format, logFormatJSON, logFormatText)
+	}
+	// records of the log package, e.g. errors of the HTTP server, are logged at info level
+	slog.SetDefault(slog.New(&levelHandler{handler: handler}))
+	return nil
+}
+
+// Log at error level and exit, the replacement of log.Fatalf
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Logger of the records of a session
+func (s *session) logger() *slog.Logger {
+	return slog.With("session", s.ID)
+}
+
+// Logger of the records of a session about a client pod, filtered by the
+// level of the client pod
+func (s *session) podLogger(pod string) *slog.Logger {
+	return s.logger().With("pod", pod)
+}
+
+// Log levels returned and set by /loglevel
+type logLevels struct {
+	Level string            `json:"level"`
+	Pods  map[string]string `json:"pods"`
+}
+
+// Change of /loglevel: the level of pod when set, the global level otherwise.
+// An empty level removes the level of pod.
+type logLevelUpdate struct {
+	Level string `json:"level"`
+	Pod   string `json:"pod,omitempty"`
+}
+
+func currentLogLevels() logLevels {
+	levels := logLevels{Level: strings.ToLower(logLevel.Level().String()), Pods: make(map[string]string)}
+	podLogLevelsMu.RLock()
+	defer podLogLevelsMu.RUnlock()
+	for pod, level := range podLogLevels {
+		levels.Pods[pod] = strings.ToLower(level.String())
+	}
+	return levels
+}
+
+// Return the log levels, or change the global level or the level of a client
+// pod on POST, e.g. {"pod": "10.128.2.52", "level": "debug"} to log every
+// request and result of a single client pod
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var update logLevelUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid log level update: %v", err))
+			return
+		}
+		var level slog.Level
+		if update.Level != "" {
+			if err := level.UnmarshalText([]byte(update.Level)); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		switch {
+		case update.Pod == "" && update.Level == "":
+			writeError(w, http.StatusBadRequest, "level required")
+			return
+		case update.Pod == "":
+			logLevel.Set(level)
+		case update.Level == "":
+			podLogLevelsMu.Lock()
+			delete(podLogLevels, update.Pod)
+			podLogLevelsMu.Unlock()
+		default:
+			podLogLevelsMu.Lock()
+			podLogLevels[update.Pod] = level
+			podLogLevelsMu.Unlock()
+		}
+		slog.Info("log level changed", "level", update.Level, "pod", update.Pod)
+	}
+	levels := currentLogLevels()
+	if err := json.NewEncoder(w).Encode(levels); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Reset the global and per-pod log levels once the test is done
+func resetLogLevels(t *testing.T) {
+	t.Cleanup(func() {
+		logLevel.Set(slog.LevelInfo)
+		podLogLevelsMu.Lock()
+		podLogLevels = make(map[string]slog.Level)
+		podLogLevelsMu.Unlock()
+	})
+}
+
+// Messages of the records logged to buf
+func loggedMessages(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record struct {
+			Msg string `json:"msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("decode %s: %v", line, err)
+		}
+		msgs = append(msgs, record.Msg)
+	}
+	buf.Reset()
+	return msgs
+}
+
+// Records about a pod with its own level are filtered by it, whatever the
+// attributes and groups added after the pod
+func TestLevelHandlerPodOverride(t *testing.T) {
+	resetLogLevels(t)
+	var buf bytes.Buffer
+	logger := slog.New(&levelHandler{handler: slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug - 4})})
+	logLevel.Set(slog.LevelWarn)
+	podLogLevelsMu.Lock()
+	podLogLevels["pod-a"] = slog.LevelDebug
+	podLogLevels["pod-b"] = slog.LevelError
+	podLogLevelsMu.Unlock()
+
+	session := logger.With("session", "1")
+	podA := session.With("pod", "pod-a").With("attempt", 2).WithGroup("request")
+	podB := session.With("pod", "pod-b")
+	podC := session.With("pod", "pod-c")
+	for _, l := range []*slog.Logger{session, podA, podB, podC} {
+		l.Debug("debug")
+		l.Info("info")
+		l.Warn("warn")
+		l.Error("error")
+	}
+	want := []string{
+		"warn", "error",
+		"debug", "info", "warn", "error",
+		"error",
+		"warn", "error",
+	}
+	if msgs := loggedMessages(t, &buf); !reflect.DeepEqual(msgs, want) {
+		t.Errorf("expected records %v, got %v", want, msgs)
+	}
+
+	// removing the level of pod-a puts its records back under the global level
+	podLogLevelsMu.Lock()
+	delete(podLogLevels, "pod-a")
+	podLogLevelsMu.Unlock()
+	podA.Info("info")
+	podA.Warn("warn")
+	if msgs := loggedMessages(t, &buf); !reflect.DeepEqual(msgs, []string{"warn"}) {
+		t.Errorf("expected only the warning of pod-a, got %v", msgs)
+	}
+}
+
+// POST a log level update to /loglevel, returning the status code and the levels replied
+func postLogLevel(t *testing.T, url, body string) (int, logLevels) {
+	t.Helper()
+	resp, err := http.Post(url+"/loglevel", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("post %s: %v", body, err)
+	}
+	defer resp.Body.Close()
+	var levels logLevels
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&levels); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+	}
+	return resp.StatusCode, levels
+}
+
+func TestLogLevelEndpoint(t *testing.T) {
+	resetLogLevels(t)
+	proxy := newTestProxy(t, nil)
+	var levels logLevels
+	getJSON(t, proxy, "/loglevel", &levels)
+	if levels.Level != "info" || len(levels.Pods) != 0 {
+		t.Errorf("expected info without pod levels, got %+v", levels)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+		want   logLevels
+	}{
+		{"pod level", `{"pod":"pod-a","level":"debug"}`, http.StatusOK, logLevels{Level: "info", Pods: map[string]string{"pod-a": "debug"}}},
+		{"global level", `{"level":"WARN"}`, http.StatusOK, logLevels{Level: "warn", Pods: map[string]string{"pod-a": "debug"}}},
+		{"unknown level", `{"pod":"pod-b","level":"verbose"}`, http.StatusBadRequest, logLevels{}},
+		{"no level", `{}`, http.StatusBadRequest, logLevels{}},
+		{"invalid JSON", `{"level":`, http.StatusBadRequest, logLevels{}},
+		{"pod level removed", `{"pod":"pod-a"}`, http.StatusOK, logLevels{Level: "warn", Pods: map[string]string{}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, levels := postLogLevel(t, proxy.BaseURL, tc.body)
+			if status != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, status)
+			}
+			if status == http.StatusOK && !reflect.DeepEqual(levels, tc.want) {
+				t.Errorf("expected levels %+v, got %+v", tc.want, levels)
+			}
+		})
+	}
+	if level := podLogLevel("pod-a"); level != slog.LevelWarn {
+		t.Errorf("expected pod-a back to the global level, got %v", level)
+	}
+}
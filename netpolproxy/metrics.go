@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "netpolproxy"
+
+var (
+	podsTargeted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_targeted",
+		Help:      "number of client pods of the current session",
+	})
+	podsDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_delivered_total",
+		Help:      "increments every time connections are sent to a client pod",
+	})
+	podsCollected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_collected_total",
+		Help:      "increments every time results are retrieved from a client pod",
+	})
+	podsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_failed_total",
+		Help:      "increments every time the proxy gives up on a client pod, by phase: delivery or collection",
+	}, []string{"phase"})
+	resultsCollected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "results_collected_total",
+		Help:      "number of connection test results retrieved from client pods, by network policy",
+	}, []string{"netpol"})
+	connectionTests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connection_tests",
+		Help:      "number of connection tests, one per address and port, sent to client pods in the current session, by network policy",
+	}, []string{"netpol"})
+	connectionsReady = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections_ready",
+		Help:      "number of connection tests of the current session client pods reached so far, updated when polling and collecting results",
+	})
+	fanOutStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fanout_requests_started_total",
+		Help:      "number of requests started to client pods, by phase: delivery, collection or polling",
+	}, []string{"phase"})
+	fanOutInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "fanout_requests_in_flight",
+		Help:      "number of requests to client pods in progress, by phase",
+	}, []string{"phase"})
+	fanOutAchievedRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "fanout_achieved_rate",
+		Help:      "requests started to client pods per second during the last fan-out, by phase",
+	}, []string{"phase"})
+	deliveryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "round-trip time of sending connections to a client pod",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+	collectionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "collection_duration_seconds",
+		Help:      "round-trip time of retrieving results from a client pod",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+)
+
+func registerMetrics() {
+	prometheus.MustRegister(podsTargeted)
+	prometheus.MustRegister(podsDelivered)
+	prometheus.MustRegister(podsCollected)
+	prometheus.MustRegister(podsFailed)
+	prometheus.MustRegister(resultsCollected)
+	prometheus.MustRegister(connectionTests)
+	prometheus.MustRegister(connectionsReady)
+	prometheus.MustRegister(fanOutStarted)
+	prometheus.MustRegister(fanOutInFlight)
+	prometheus.MustRegister(fanOutAchievedRate)
+	prometheus.MustRegister(deliveryDuration)
+	prometheus.MustRegister(collectionDuration)
+}
+
+// Reset the per-session gauges for a new session
+func setSessionMetrics(conns map[string][]connection) {
+	podsTargeted.Set(float64(len(conns)))
+	connectionsReady.Set(0)
+	connectionTests.Reset()
+	for _, cts := range conns {
+		for _, key := range expectedConnTests(cts) {
+			connectionTests.WithLabelValues(key.NpName).Inc()
+		}
+	}
+}
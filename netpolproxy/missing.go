@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Address and port a client pod never reached
+type missingConn struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// Connection tests of a client pod which never became reachable, by group,
+// e.g. network policy
+type podMissing struct {
+	Pod string `json:"pod"`
+	// collection status of the pod, to tell pods which failed from pods which answered
+	Collection string `json:"collection"`
+	Error      string `json:"error,omitempty"`
+	NoResults  bool   `json:"noResults"`
+	Expected   int    `json:"expected"`
+	Missing    int    `json:"missing"`
+	// encoded under the groups key of the workload type, e.g. policies
+	Groups    map[string][]missingConn `json:"-"`
+	groupsKey string
+}
+
+func (pm podMissing) MarshalJSON() ([]byte, error) {
+	type fields podMissing
+	return marshalWithGroups(fields(pm), pm.groupsKey, pm.Groups)
+}
+
+// Expected connection tests of a session missing from its results, returned by /missing
+type missingReport struct {
+	Session            string       `json:"session"`
+	Phase              phase        `json:"phase"`
+	Expected           int          `json:"expected"`
+	Missing            int          `json:"missing"`
+	PodsWithoutResults []string     `json:"podsWithoutResults"`
+	Pods               []podMissing `json:"pods"`
+}
+
+// Diff the connection tests expected from the connections received on
+// /initiate against the results collected so far. Only pods with missing
+// connection tests are listed.
+func (s *session) missing(filter resultsFilter) missingReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groupsKey := s.workloadType().grouping().key
+	report := missingReport{
+		Session:            s.ID,
+		Phase:              s.phase,
+		PodsWithoutResults: []string{},
+		Pods:               []podMissing{},
+	}
+	for pod, conns := range s.connections {
+		if !filter.matchPod(pod) {
+			continue
+		}
+		results := s.clusterResults[pod]
+		reached := make(map[connKey]bool, len(results))
+		for _, res := range results {
+			reached[connKey{Address: res.Address, Port: res.Port, NpName: res.NpName}] = true
+		}
+		pm := podMissing{
+			Pod:        pod,
+			Collection: statusPending,
+			NoResults:  len(results) == 0,
+			Groups:     make(map[string][]missingConn),
+			groupsKey:  groupsKey,
+		}
+		if ps, ok := s.podStatuses[pod]; ok {
+			pm.Collection = ps.Collection
+			pm.Error = ps.CollectionError
+		}
+		for _, key := range expectedConnTests(conns) {
+			if !filter.matchResult(connTest{NpName: key.NpName}) {
+				continue
+			}
+			pm.Expected++
+			if !reached[key] {
+				pm.Missing++
+				pm.Groups[key.NpName] = append(pm.Groups[key.NpName], missingConn{Address: key.Address, Port: key.Port})
+			}
+		}
+		report.Expected += pm.Expected
+		report.Missing += pm.Missing
+		if pm.NoResults {
+			report.PodsWithoutResults = append(report.PodsWithoutResults, pod)
+		}
+		if pm.Missing > 0 {
+			report.Pods = append(report.Pods, pm)
+		}
+	}
+	sort.Strings(report.PodsWithoutResults)
+	sort.Slice(report.Pods, func(i, j int) bool { return report.Pods[i].Pod < report.Pods[j].Pod })
+	return report
+}
+
+// Return the connection tests which never became reachable, optionally
+// restricted to some client pods and groups
+func handleMissing(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(s.missing(s.resultsFilter(r))); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"example.com/netpolprotocol"
+)
+
+// Entry of /missing, with the missing connection tests of every network policy
+type missingPod struct {
+	podMissing
+	Policies map[string][]missingConn `json:"policies"`
+}
+
+// /missing lists every expected connection test of a pod which never got its
+// connections and of a pod whose results were never collected, with the
+// collection status telling them from pods which answered
+func TestMissingUndeliveredAndUncollected(t *testing.T) {
+	maxRetries = 0
+	t.Cleanup(func() { maxRetries = defaultMaxRetries })
+	pods := map[string]*testPod{"pod-a": newTestPod(t), "pod-c": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	// pod-b can't be resolved, connections never reach it
+	conns := map[string][]connection{
+		"pod-a": {{Addresses: []string{"10.0.0.1"}, Ports: []int32{8080}, Netpol: "np1"}},
+		"pod-b": {{Addresses: []string{"10.0.0.2"}, Ports: []int32{8080, 8443}, Netpol: "np1"}},
+		"pod-c": {
+			{Addresses: []string{"10.0.0.3"}, Ports: []int32{8080}, Netpol: "np1"},
+			{Addresses: []string{"10.0.0.4"}, Ports: []int32{80}, Netpol: "np2"},
+		},
+	}
+	session, err := proxy.Initiate(ctx, "", netpolprotocol.InitiateRequest{Connections: conns})
+	if err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	if status := waitConnectionsSent(t, proxy, session); len(status.FailedPods) != 1 || status.FailedPods[0] != "pod-b" {
+		t.Errorf("expected delivery to pod-b to fail, got %+v", status)
+	}
+	// pod-c goes away before its results are collected
+	pods["pod-c"].Close()
+	if err := proxy.Stop(ctx, session); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, session)
+
+	var report struct {
+		missingReport
+		Pods []missingPod `json:"pods"`
+	}
+	getJSON(t, proxy, "/missing?session="+session, &report)
+	if report.Session != session || report.Phase != phaseCollected {
+		t.Errorf("expected collected session %s, got %s in phase %v", session, report.Session, report.Phase)
+	}
+	if report.Expected != 5 || report.Missing != 4 {
+		t.Errorf("expected 4 of 5 connection tests missing, got %d of %d", report.Missing, report.Expected)
+	}
+	if !reflect.DeepEqual(report.PodsWithoutResults, []string{"pod-b", "pod-c"}) {
+		t.Errorf("expected pod-b and pod-c without results, got %v", report.PodsWithoutResults)
+	}
+	if len(report.Pods) != 2 {
+		t.Fatalf("expected pod-b and pod-c listed, got %+v", report.Pods)
+	}
+	undelivered, uncollected := report.Pods[0], report.Pods[1]
+	if undelivered.Pod != "pod-b" || !undelivered.NoResults || undelivered.Expected != 2 || undelivered.Missing != 2 ||
+		!reflect.DeepEqual(undelivered.Policies, map[string][]missingConn{"np1": {{"10.0.0.2", 8080}, {"10.0.0.2", 8443}}}) {
+		t.Errorf("expected both connection tests of pod-b missing, got %+v", undelivered)
+	}
+	if undelivered.Collection != statusFailed || undelivered.Error == "" {
+		t.Errorf("expected the collection of pod-b failed with its error, got %s %q", undelivered.Collection, undelivered.Error)
+	}
+	if uncollected.Pod != "pod-c" || !uncollected.NoResults || uncollected.Expected != 2 || uncollected.Missing != 2 ||
+		!reflect.DeepEqual(uncollected.Policies, map[string][]missingConn{"np1": {{"10.0.0.3", 8080}}, "np2": {{"10.0.0.4", 80}}}) {
+		t.Errorf("expected both connection tests of pod-c missing, got %+v", uncollected)
+	}
+	if uncollected.Collection != statusFailed || uncollected.Error == "" {
+		t.Errorf("expected the collection of pod-c failed with its error, got %s %q", uncollected.Collection, uncollected.Error)
+	}
+
+	// filters restrict the report to some pods and policies
+	getJSON(t, proxy, "/missing?netpol=np2&session="+session, &report)
+	if report.Expected != 1 || report.Missing != 1 || len(report.Pods) != 1 || report.Pods[0].Pod != "pod-c" {
+		t.Errorf("expected only the np2 connection test of pod-c, got %+v", report)
+	}
+	var raw map[string]json.RawMessage
+	getJSON(t, proxy, "/missing?pod=pod-a&session="+session, &raw)
+	if string(raw["missing"]) != "0" || string(raw["pods"]) != "[]" {
+		t.Errorf("expected nothing missing for pod-a, got %s", raw)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Network policy latency: client pods get the connections network policies
+// allow on /check and report when they first reached each of them
+type netpolWorkload struct{}
+
+func init() {
+	registerWorkload(netpolprotocol.WorkloadNetpol, netpolWorkload{})
+}
+
+func (netpolWorkload) decode(body []byte) (*initiateRequest, error) {
+	return decodeInitiate(body)
+}
+
+func (netpolWorkload) validate(req *initiateRequest) []string {
+	return validateInitiate(req)
+}
+
+func (netpolWorkload) deliveryPath() string {
+	return "/check"
+}
+
+func (netpolWorkload) streamResults(ctx context.Context, pod string, batchSize int, fn func(batch []connTest) error) error {
+	return podClient.StreamResults(ctx, pod, batchSize, fn)
+}
+
+func (netpolWorkload) reportedResults(report *resultsReport) []connTest {
+	return report.Results
+}
+
+func (netpolWorkload) encodeResult(pod string, res connTest) interface{} {
+	return resultRow{Pod: pod, connTest: res}
+}
+
+// Latencies are measured from the creation time of the network policy, when
+// kube-burner sent it on /initiate
+func (netpolWorkload) latencyReference(s *session, netpol string) (time.Time, bool) {
+	created, ok := s.netpolCreated[netpol]
+	return created, ok
+}
+
+func (netpolWorkload) grouping() grouping {
+	return grouping{key: "policies", column: "netpol", index: "ingressidx"}
+}
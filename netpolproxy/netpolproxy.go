@@ -1,234 +1,434 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
-)
-
-type connection struct {
-	Addresses []string `json:"addresses"`
-	Ports     []int32  `json:"ports"`
-	Netpol    string   `json:"netpol"`
-}
-
-type connTest struct {
-	Address    string    `json:"address"`
-	Port       int       `json:"port"`
-	IngressIdx int       `json:"ingressidx"`
-	NpName     string    `json:"npname"`
-	Timestamp  time.Time `json:"timestamp"`
-}
 
-const (
-	podPort             = 9001
-	parallelConnections = 20
+	"example.com/netpolprotocol"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	connections         = make(map[string][]connection)
-	connWg              sync.WaitGroup
-	sendConnectionsDone bool
-	checkStopDone       bool
-	sendConnMutex       sync.Mutex
-	checkStopMutex      sync.Mutex
-	resWg               sync.WaitGroup
-	clusterResults      = make(map[string][]connTest)
-	resultsMutex        sync.Mutex
-	doneInitiate        = make(chan bool)
-)
-
-type ProxyResponse struct {
-	Result bool `json:"result"`
-}
-
-// Send connections to all pods
-func sendNetpolInfo(pod string, connInfo []connection, semaphore chan struct{}) {
-	defer connWg.Done()
-	defer func() { <-semaphore }()
-	data, err := json.Marshal(connInfo)
-	if err != nil {
-		log.Fatalf("Failed to marshal payload: %v", err)
+// Send connections to a single pod, on the endpoint of the workload type of
+// the session, retrying with exponential backoff
+func (s *session) sendPodConnections(pod string, connInfo []connection, f *fanOut) {
+	defer s.connWg.Done()
+	defer f.release()
+	setStatus := func(status string, attempts int, err error) {
+		s.updatePodStatus(pod, func(ps *podStatus) {
+			ps.Delivery = status
+			ps.DeliveryAttempts = attempts
+			ps.DeliveryError = ""
+			if err != nil {
+				ps.DeliveryError = err.Error()
+			}
+		})
 	}
-
-	url := fmt.Sprintf("http://%s:%d/check", pod, podPort)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	attempts := 0
+	logger := s.podLogger(pod)
+	err := retryPod(context.Background(), logger, "send connections", setStatus, func() error {
+		attempts++
+		start := time.Now()
+		err := podClient.Deliver(context.Background(), pod, s.workloadType().deliveryPath(), connInfo)
+		deliveryDuration.Observe(time.Since(start).Seconds())
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to send request: %v", err)
-	}
-	resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		log.Printf("Connections sent to %s successfully", url)
+		logger.Error("failed to send connections", "error", err)
+		podsFailed.WithLabelValues("delivery").Inc()
+		setStatus(statusFailed, attempts, err)
+		return
 	}
+	logger.Debug("connections sent", "attempts", attempts)
+	podsDelivered.Inc()
+	setStatus(statusDelivered, attempts, nil)
+	s.measureClock(pod)
 }
 
-// Wait for connections from kube-burner. Once it recieves connections,
-// send them to client pods using 20 threads.
-func sendConnections() {
-	log.Printf("Wait for Connections from kube-burner..")
-	<-doneInitiate
-	log.Printf("Got connections from kube-burner, sending them to %d pods", len(connections))
-	semaphore := make(chan struct{}, parallelConnections)
-	for pod, connInfo := range connections {
-		semaphore <- struct{}{}
-		connWg.Add(1)
-		go sendNetpolInfo(pod, connInfo, semaphore)
-	}
-	connWg.Wait()
-	sendConnMutex.Lock()
-	sendConnectionsDone = true
-	sendConnMutex.Unlock()
+// Send the connections received from kube-burner to client pods using parallelConnections threads.
+func (s *session) sendConnections() {
+	if err := s.transition(phaseIdle, phaseDistributing); err != nil {
+		s.logger().Warn(err.Error())
+		return
+	}
+	s.logger().Info("sending connections", "pods", len(s.connections))
+	f := newFanOut("delivery")
+	for pod, connInfo := range s.connections {
+		// pods already delivered before a proxy restart
+		if s.getPodStatus(pod).Delivery == statusDelivered {
+			continue
+		}
+		f.acquire(context.Background())
+		s.connWg.Add(1)
+		go s.sendPodConnections(pod, connInfo, f)
+	}
+	s.connWg.Wait()
+	f.finish(s.ID)
+	collect := s.finishDistribution()
+	failed := s.failedPods(false)
+	s.logger().Info("delivery summary", "pods", len(s.connections), "delivered", len(s.connections)-len(failed), "failed", len(failed))
+	if len(failed) > 0 {
+		s.logger().Warn("failed to send connections to some pods", "failedPods", failed)
+	}
+	if collect {
+		// /stop was requested while connections were being sent
+		go s.getResults()
+	}
+	flushState()
 }
 
 // kube-burner periodically checks if this proxy pod sent connections to all the client pods or not.
-// It replies with "true" once connections are succesfully sent to all client pods.
+// It replies with "true" once connections are sent to all client pods, along
+// with the pods it failed to send them to.
 func handleCheckConnectionsStatus(w http.ResponseWriter, r *http.Request) {
-	sendConnMutex.Lock()
-	defer sendConnMutex.Unlock()
-	result := false
-
-	if sendConnectionsDone {
-		result = true
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	response := ProxyResponse{Result: s.connectionsSent(), Session: s.ID}
+	if response.Result {
+		response.FailedPods = s.failedPods(false)
+		response.Partial = len(response.FailedPods) > 0
 	}
-	response := ProxyResponse{Result: result}
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
-		log.Println("Error encoding response:", err)
+		slog.Error("failed to encode response", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 }
 
 // kube-burner periodically checks if this proxy pod retrived results from all the client pods or not.
-// It replies with "true" once it received results from all client pods.
+// It replies with "true" once it tried to retrieve results from all client pods,
+// along with the pods it failed to retrieve them from.
 func handleCheckStopStatus(w http.ResponseWriter, r *http.Request) {
-	checkStopMutex.Lock()
-	defer checkStopMutex.Unlock()
-
-	result := false
-
-	if checkStopDone {
-		result = true
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	response := ProxyResponse{Result: s.resultsCollected(), Session: s.ID}
+	if response.Result {
+		response.FailedPods = s.failedPods(true)
+		response.Partial = len(response.FailedPods) > 0
 	}
-	response := ProxyResponse{Result: result}
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
-		log.Println("Error encoding response:", err)
+		slog.Error("failed to encode response", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 }
 
-// Get connections from kube-burner
+// Get connections from kube-burner and start a new session. The session ID
+// can be set with the session query parameter, otherwise it is a sequence number.
+// The workload query parameter selects the workload type, netpol by default.
+// The payload is validated before it is acknowledged.
 func handleInitiate(w http.ResponseWriter, r *http.Request) {
-	// Send an immediate response to the client
-	fmt.Fprintln(w, "Initiate Request received, processing...")
-
+	if shuttingDown.Load() {
+		writeError(w, http.StatusServiceUnavailable, "proxy is shutting down")
+		return
+	}
+	workload := r.URL.Query().Get("workload")
+	if workload == "" {
+		workload = defaultWorkload
+	}
+	wt, err := lookupWorkload(workload)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	// Read data from the request
-	body, err := ioutil.ReadAll(r.Body)
+	reqBody, err := netpolprotocol.RequestBody(r)
 	if err != nil {
-		http.Error(w, "Unable to read response body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	err = json.Unmarshal(body, &connections)
+	body, err := ioutil.ReadAll(reqBody)
 	if err != nil {
-		http.Error(w, "Unable to parse response body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to read request body: %v", err))
 		return
 	}
-	r.Body.Close()
-	log.Printf("Number of connections got from kube-burner %d", len(connections))
-	doneInitiate <- true
+	reqBody.Close()
+	req, err := wt.decode(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errs := wt.validate(req); len(errs) > 0 {
+		slog.Warn("rejected invalid payload", "workload", workload, "schemaVersion", req.SchemaVersion, "errors", errs)
+		writeError(w, http.StatusUnprocessableEntity, "invalid connections", errs...)
+		return
+	}
+	conns := req.Connections
+
+	s, err := registry.start(r.URL.Query().Get("session"), workload, req)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	setSessionMetrics(conns)
+	if sim != nil {
+		sim.reset()
+	}
+
+	w.Header().Set("X-Session-Id", s.ID)
+	fmt.Fprintf(w, "Initiate Request received for session %s, processing...\n", s.ID)
+	s.logger().Info("connections received from kube-burner", "workload", workload, "pods", len(conns), "schemaVersion", req.SchemaVersion)
+	flushState()
+	go s.sendConnections()
+	if pollInterval > 0 {
+		go s.pollResults()
+	}
 }
 
 // kube-burner requested to collect results from client pods
 func handleStop(w http.ResponseWriter, r *http.Request) {
-	// Send an immediate response to the client
-	fmt.Fprintln(w, "Stop Request received, processing...")
-
-	// Read data from the request
-	_, err := ioutil.ReadAll(r.Body)
+	// Drain the request, its body is unused
+	_, err := io.Copy(io.Discard, r.Body)
 	if err != nil {
-		http.Error(w, "Unable to read response body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to read request body: %v", err))
 		return
 	}
 	r.Body.Close()
-
-	// Get results from all pods
-	go getResults(connections)
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	already, collect := s.requestStop()
+	fmt.Fprintf(w, "Stop Request received for session %s, processing...\n", s.ID)
+	if already {
+		return
+	}
+	flushState()
+	if collect {
+		// Get results from all pods
+		go s.getResults()
+	} else {
+		s.logger().Info("stop requested while sending connections, results are retrieved once they are sent")
+	}
 }
 
-// Get results from a single pod
-func getPodResult(pod string, semaphore chan struct{}) {
-	defer resWg.Done()
-	defer func() { <-semaphore }()
+// Get results from a single pod, retrying with exponential backoff until ctx is done
+func (s *session) getPodResult(ctx context.Context, pod string, f *fanOut) {
+	defer s.resWg.Done()
+	defer f.release()
 
-	url := fmt.Sprintf("http://%s:%d/results", pod, podPort)
-	// Retrieve the results
-	resp, err := http.Get(url)
+	setStatus := func(status string, attempts int, err error) {
+		s.updatePodStatus(pod, func(ps *podStatus) {
+			ps.Collection = status
+			ps.CollectionAttempts = attempts
+			ps.CollectionError = ""
+			if err != nil {
+				ps.CollectionError = err.Error()
+			}
+		})
+	}
+	var received, added int
+	attempts := 0
+	logger := s.podLogger(pod)
+	err := retryPod(ctx, logger, "retrieve results", setStatus, func() error {
+		var err error
+		attempts++
+		start := time.Now()
+		received, added, err = s.streamPodResults(ctx, pod)
+		collectionDuration.Observe(time.Since(start).Seconds())
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to retrieve results: %v", err)
+		logger.Error("failed to retrieve results", "error", err)
+		podsFailed.WithLabelValues("collection").Inc()
+		setStatus(statusFailed, attempts, err)
+		return
 	}
-	defer resp.Body.Close()
+	logger.Debug("results retrieved", "results", received, "new", added, "attempts", attempts)
+	podsCollected.Inc()
+	setStatus(statusCollected, attempts, nil)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Unexpected status code: %d", resp.StatusCode)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Failed to read response body: %v", err)
+// Retrieve the results of pod and merge them into the session batch by batch,
+// so the results of a client pod are never held twice in memory. Results
+// already pulled while polling or by a failed attempt are merged, not
+// counted twice. Returns the number of results received and of new ones.
+func (s *session) streamPodResults(ctx context.Context, pod string) (received, added int, err error) {
+	logger := s.podLogger(pod)
+	err = s.workloadType().streamResults(ctx, pod, resultsBatchSize, func(batch []connTest) error {
+		received += len(batch)
+		for _, res := range s.mergeResults(pod, batch) {
+			logger.Debug("result", "address", res.Address, "port", res.Port, "ingressidx", res.IngressIdx, "npname", res.NpName, "timestamp", res.Timestamp)
+			resultsCollected.WithLabelValues(res.NpName).Inc()
+			added++
+		}
+		return nil
+	})
+	if err == nil {
+		// pods without results are listed with an empty list
+		s.mergeResults(pod, nil)
 	}
+	return received, added, err
+}
 
-	var results []connTest
-	if err := json.Unmarshal(body, &results); err != nil {
-		log.Fatalf("Failed to unmarshal results: %v", err)
+// Get results from all pods, pulling them or waiting for client pods to push
+// them depending on resultsMode. In push mode, results of client pods which
+// didn't push their final batch within reportWait are pulled. When the
+// collection deadline is reached, pods which didn't return their results yet
+// are marked as failed.
+func (s *session) getResults() {
+	s.logger().Info("retrieving results", "pods", len(s.connections), "mode", resultsMode)
+	ctx := context.Background()
+	if collectionDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, collectionDeadline)
+		defer cancel()
 	}
-	for _, res := range results {
-		log.Printf("Address: %s, Port: %d, IngressIdx: %v, NpName: %s Timestamp: %v\n", res.Address, res.Port, res.IngressIdx, res.NpName, res.Timestamp)
+	if resultsMode == resultsModePush {
+		waitCtx, cancel := context.WithTimeout(ctx, reportWait)
+		pending := s.waitForReports(waitCtx)
+		cancel()
+		if pending > 0 {
+			s.logger().Info("pulling results of pods which didn't push their final results", "pendingPods", pending, "reportWait", reportWait.String())
+		}
 	}
-	resultsMutex.Lock()
-	clusterResults[pod] = results
-	resultsMutex.Unlock()
+	s.pullResults(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		s.logger().Warn("collection deadline exceeded", "deadline", collectionDeadline.String())
+	}
+	if err := s.transition(phaseCollecting, phaseCollected); err != nil {
+		s.logger().Warn(err.Error())
+	}
+	progress := s.progress()
+	connectionsReady.Set(float64(progress.Ready))
+	failed := s.failedPods(true)
+	missing := s.missing(resultsFilter{})
+	s.logger().Info("collection summary", "pods", len(s.connections), "collected", len(s.connections)-len(failed), "failed", len(failed),
+		"ready", progress.Ready, "expected", missing.Expected, "missing", missing.Missing, "podsWithoutResults", len(missing.PodsWithoutResults))
+	if len(failed) > 0 {
+		s.logger().Warn("failed to retrieve results from some pods", "failedPods", failed)
+	}
+	if missing.Missing > 0 {
+		s.logger().Warn("some connection tests never became reachable, see /missing", "missing", missing.Missing)
+	}
+	flushState()
 }
 
-// Get results from all pods
-func getResults(cts map[string][]connection) {
-	semaphore := make(chan struct{}, parallelConnections)
-	for pod, _ := range cts {
-		semaphore <- struct{}{}
-		resWg.Add(1)
-		go getPodResult(pod, semaphore)
-	}
-	resWg.Wait()
-	checkStopMutex.Lock()
-	checkStopDone = true
-	checkStopMutex.Unlock()
+// Retrieve results from all pods which didn't push their final results yet
+func (s *session) pullResults(ctx context.Context) {
+	f := newFanOut("collection")
+	for pod := range s.connections {
+		// pods collected before a proxy restart, which pushed their final
+		// results or which never got their connections in push mode
+		if collection := s.getPodStatus(pod).Collection; collection == statusCollected || collection == statusFailed {
+			continue
+		}
+		if err := f.acquire(ctx); err != nil {
+			podsFailed.WithLabelValues("collection").Inc()
+			s.updatePodStatus(pod, func(ps *podStatus) {
+				ps.Collection = statusFailed
+				ps.CollectionError = "collection deadline exceeded"
+			})
+			continue
+		}
+		s.resWg.Add(1)
+		go s.getPodResult(ctx, pod, f)
+	}
+	s.resWg.Wait()
+	f.finish(s.ID)
 }
 
+// Return the results of a session as JSON, NDJSON or CSV, in the result type
+// of its workload, optionally restricted to some client pods and groups
 func resultsHandler(w http.ResponseWriter, r *http.Request) {
-	resultsMutex.Lock()
-	defer resultsMutex.Unlock()
-	if err := json.NewEncoder(w).Encode(clusterResults); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	format, err := resultsFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := s.resultsFilter(r)
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	gw := netpolprotocol.NewResponseWriter(w, r)
+	if format == formatJSON {
+		err = s.writeResultsJSON(gw, filter)
+	} else {
+		err = s.streamResults(gw, format, filter)
 	}
+	if closeErr := gw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// the status code is already sent once rows are streamed
+		s.logger().Error("failed to write results", "format", format, "error", err)
+	}
+}
+
+// Return the handlers of all endpoints of the proxy
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/initiate", requireToken(allowMethods(handleInitiate, http.MethodPost)))
+	mux.HandleFunc("/checkConnectionsStatus", requireToken(allowMethods(handleCheckConnectionsStatus, http.MethodGet)))
+	mux.HandleFunc("/stop", requireToken(allowMethods(handleStop, http.MethodGet, http.MethodPost)))
+	mux.HandleFunc("/checkStopStatus", requireToken(allowMethods(handleCheckStopStatus, http.MethodGet)))
+	mux.HandleFunc("/results", requireToken(allowMethods(resultsHandler, http.MethodGet)))
+	mux.HandleFunc("/status", requireToken(allowMethods(handleStatus, http.MethodGet)))
+	mux.HandleFunc("/sessions", requireToken(allowMethods(handleSessions, http.MethodGet)))
+	mux.HandleFunc("/summary", requireToken(allowMethods(handleSummary, http.MethodGet)))
+	mux.HandleFunc("/progress", requireToken(allowMethods(handleProgress, http.MethodGet)))
+	mux.HandleFunc("/missing", requireToken(allowMethods(handleMissing, http.MethodGet)))
+	mux.HandleFunc("/report", requireToken(allowMethods(handleReport, http.MethodPost)))
+	mux.HandleFunc("/loglevel", requireToken(allowMethods(handleLogLevel, http.MethodGet, http.MethodPost)))
+	mux.HandleFunc("/version", allowMethods(handleVersion, http.MethodGet))
+	mux.HandleFunc("/healthz", allowMethods(handleHealthz, http.MethodGet))
+	mux.HandleFunc("/readyz", allowMethods(handleReadyz, http.MethodGet))
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
 }
 
 func main() {
-	// Send connections to all pods
-	go sendConnections()
+	processEnvVars()
+	registerMetrics()
+	if simulatePods > 0 {
+		var err error
+		if sim, err = startSimulation(simulatePods); err != nil {
+			fatal("failed to start simulation", "error", err)
+		}
+		podClient.Resolver = sim
+	}
+	if store != nil {
+		state, err := store.load()
+		if err != nil {
+			fatal("failed to load state", "path", store.path, "error", err)
+		}
+		if state != nil {
+			restoreState(state)
+		}
+		go store.run()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	server := &http.Server{Addr: fmt.Sprintf(":%d", listenPort), Handler: newMux()}
 	go func() {
-		http.HandleFunc("/initiate", handleInitiate)
-		http.HandleFunc("/checkConnectionsStatus", handleCheckConnectionsStatus)
-		http.HandleFunc("/stop", handleStop)
-		http.HandleFunc("/checkStopStatus", handleCheckStopStatus)
-		http.HandleFunc("/results", resultsHandler)
-		log.Println("Client server started on :9002")
-		log.Fatal(http.ListenAndServe(":9002", nil))
+		var err error
+		slog.Info("server started", "port", listenPort, "tls", tlsCertFile != "")
+		if tlsCertFile != "" {
+			err = server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("server stopped", "error", err)
+		}
 	}()
-
-	select {} // keep the client running
+	<-ctx.Done()
+	stop()
+	shutdown(server)
 }
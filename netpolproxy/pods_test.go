@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Client pods of the current test, resolved by podClient
+var testPods = &testResolver{pods: make(map[string]*testPod)}
+
+// Globals are set once: goroutines of a session may still be writing its
+// state once the test saw it complete
+func TestMain(m *testing.M) {
+	registerMetrics()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	resultsMode = resultsModePull
+	podClient = &netpolprotocol.PodClient{
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+		Scheme:     "http",
+		Resolver:   testPods,
+	}
+	dir, err := os.MkdirTemp("", "netpolproxy")
+	if err != nil {
+		panic(err)
+	}
+	store = newStateStore(filepath.Join(dir, "state.json"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Client pod stand-in: records the connections it gets on /check or /reach
+// and reports every one of them as reached on /results, as ConnTests or
+// ReachResults depending on the endpoint
+type testPod struct {
+	*httptest.Server
+	// when set, /check waits until it is closed
+	block chan struct{}
+	// when set, results carry connectionidx like client pods predating ingressidx
+	legacy bool
+	// addresses the pod never reaches
+	unreachable map[string]bool
+
+	mu        sync.Mutex
+	path      string
+	conns     []connection
+	checks    int
+	pulls     int
+	reachedAt time.Time
+}
+
+func newTestPod(t *testing.T) *testPod {
+	p := &testPod{reachedAt: time.Now().UTC()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", p.handleCheck)
+	mux.HandleFunc("/reach", p.handleCheck)
+	mux.HandleFunc("/results", p.handleResults)
+	mux.HandleFunc("/time", p.handleTime)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testPod) handleCheck(w http.ResponseWriter, r *http.Request) {
+	var conns []connection
+	if err := json.NewDecoder(r.Body).Decode(&conns); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.block != nil {
+		<-p.block
+	}
+	p.mu.Lock()
+	p.path = r.URL.Path
+	p.conns = conns
+	p.checks++
+	p.mu.Unlock()
+}
+
+func (p *testPod) handleResults(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.pulls++
+	results := []connTest{}
+	for i, conn := range p.conns {
+		for _, address := range conn.Addresses {
+			if p.unreachable[address] {
+				continue
+			}
+			for _, port := range conn.Ports {
+				results = append(results, connTest{Address: address, Port: int(port), IngressIdx: i, NpName: conn.Netpol, Timestamp: p.reachedAt})
+			}
+		}
+	}
+	path := p.path
+	p.mu.Unlock()
+	if path == "/reach" {
+		reached := make([]netpolprotocol.ReachResult, 0, len(results))
+		for _, res := range results {
+			reached = append(reached, netpolprotocol.ReachResult{Address: res.Address, Port: res.Port, TargetIdx: res.IngressIdx, Group: res.NpName, Timestamp: res.Timestamp})
+		}
+		json.NewEncoder(w).Encode(reached)
+		return
+	}
+	if !p.legacy {
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+	legacy := make([]map[string]interface{}, 0, len(results))
+	for _, res := range results {
+		legacy = append(legacy, map[string]interface{}{"address": res.Address, "port": res.Port, "connectionidx": res.IngressIdx, "npname": res.NpName, "timestamp": res.Timestamp})
+	}
+	json.NewEncoder(w).Encode(legacy)
+}
+
+func (p *testPod) handleTime(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(netpolprotocol.TimeResponse{Time: time.Now().UTC()})
+}
+
+// Number of /check and /results requests the pod got
+func (p *testPod) requests() (checks, pulls int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.checks, p.pulls
+}
+
+// Resolves pod keys to the address of their stand-in
+type testResolver struct {
+	mu   sync.Mutex
+	pods map[string]*testPod
+}
+
+func (r *testResolver) Resolve(ctx context.Context, pod string) (string, error) {
+	r.mu.Lock()
+	p, ok := r.pods[pod]
+	r.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown pod %s", pod)
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return "", err
+	}
+	return u.Host, nil
+}
+
+// Start a proxy without sessions talking to pods
+func newTestProxy(t *testing.T, pods map[string]*testPod) *netpolprotocol.ProxyClient {
+	registry.mu.Lock()
+	registry.sessions = make(map[string]*session)
+	registry.ids = nil
+	registry.current = nil
+	registry.created = 0
+	registry.mu.Unlock()
+	testPods.mu.Lock()
+	testPods.pods = pods
+	testPods.mu.Unlock()
+	server := httptest.NewServer(newMux())
+	t.Cleanup(server.Close)
+	return &netpolprotocol.ProxyClient{BaseURL: server.URL}
+}
+
+// Connections of every pod, one network policy per pod
+func testConnections(pods map[string]*testPod) map[string][]connection {
+	conns := make(map[string][]connection)
+	i := 0
+	for pod := range pods {
+		i++
+		conns[pod] = []connection{{Addresses: []string{fmt.Sprintf("10.0.0.%d", i)}, Ports: []int32{8080, 8443}, Netpol: fmt.Sprintf("np%d", i)}}
+	}
+	return conns
+}
+
+// Poll check until it returns true, failing the test after 10 seconds
+func waitFor(t *testing.T, what string, check func() (bool, error)) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		done, err := check()
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Wait until connections of the current session are sent to all pods
+func waitConnectionsSent(t *testing.T, proxy *netpolprotocol.ProxyClient, session string) netpolprotocol.ProxyResponse {
+	t.Helper()
+	var status netpolprotocol.ProxyResponse
+	waitFor(t, "connections sent", func() (bool, error) {
+		var err error
+		status, err = proxy.ConnectionsStatus(context.Background(), session)
+		return status.Result, err
+	})
+	return status
+}
+
+// Wait until results of the current session are collected from all pods
+func waitResultsCollected(t *testing.T, proxy *netpolprotocol.ProxyClient, session string) netpolprotocol.ProxyResponse {
+	t.Helper()
+	var status netpolprotocol.ProxyResponse
+	waitFor(t, "results collected", func() (bool, error) {
+		var err error
+		status, err = proxy.StopStatus(context.Background(), session)
+		return status.Result, err
+	})
+	return status
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Live progress of a session returned by /progress
+type progressInfo struct {
+	Session       string     `json:"session"`
+	Phase         phase      `json:"phase"`
+	Pods          int        `json:"pods"`
+	PodsReporting int        `json:"podsReporting"`
+	Ready         int        `json:"ready"`
+	Total         int        `json:"total"`
+	Percent       float64    `json:"percent"`
+	LastPoll      *time.Time `json:"lastPoll,omitempty"`
+}
+
+// Merge results reported by pod into the session. Client pods report all
+// their results every time, so a connection test already known is only
+// updated when the new result is older. Returns the results not known before.
+func (s *session) mergeResults(pod string, results []connTest) []connTest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing := s.clusterResults[pod]
+	index := make(map[connKey]int, len(existing))
+	for i, res := range existing {
+		index[connKey{Address: res.Address, Port: res.Port, NpName: res.NpName}] = i
+	}
+	var added []connTest
+	for _, res := range results {
+		key := connKey{Address: res.Address, Port: res.Port, NpName: res.NpName}
+		if i, ok := index[key]; ok {
+			if res.Timestamp.Before(existing[i].Timestamp) {
+				existing[i] = res
+			}
+			continue
+		}
+		index[key] = len(existing)
+		existing = append(existing, res)
+		added = append(added, res)
+	}
+	if existing == nil {
+		existing = []connTest{}
+	}
+	s.clusterResults[pod] = existing
+	s.correctTimestamps(pod)
+	return added
+}
+
+// Count the expected connection tests of the session and how many of them
+// client pods reached so far
+func (s *session) progress() progressInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := progressInfo{
+		Session: s.ID,
+		Phase:   s.phase,
+		Pods:    len(s.connections),
+	}
+	if !s.lastPoll.IsZero() {
+		lastPoll := s.lastPoll
+		info.LastPoll = &lastPoll
+	}
+	for pod, conns := range s.connections {
+		results := s.clusterResults[pod]
+		if len(results) > 0 {
+			info.PodsReporting++
+		}
+		reached := make(map[connKey]bool, len(results))
+		for _, res := range results {
+			reached[connKey{Address: res.Address, Port: res.Port, NpName: res.NpName}] = true
+		}
+		for _, key := range expectedConnTests(conns) {
+			info.Total++
+			if reached[key] {
+				info.Ready++
+			}
+		}
+	}
+	if info.Total > 0 {
+		info.Percent = 100 * float64(info.Ready) / float64(info.Total)
+	}
+	return info
+}
+
+// Pull partial results from the client pods every pollInterval, until
+// results are collected after /stop
+func (s *session) pollResults() {
+	s.logger().Info("polling results", "interval", pollInterval.String())
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.getPhase() >= phaseCollecting {
+			return
+		}
+		s.pollOnce()
+	}
+}
+
+// Pull the results of every client pod which got its connections, once.
+// Failures are only logged, the pod is polled again on the next round and
+// collected as usual after /stop.
+func (s *session) pollOnce() {
+	f := newFanOut("polling")
+	var wg sync.WaitGroup
+	for pod := range s.connections {
+		if s.getPodStatus(pod).Delivery != statusDelivered {
+			continue
+		}
+		f.acquire(context.Background())
+		wg.Add(1)
+		go func(pod string) {
+			defer wg.Done()
+			defer f.release()
+			if _, _, err := s.streamPodResults(context.Background(), pod); err != nil {
+				s.podLogger(pod).Warn("failed to poll results", "error", err)
+			}
+		}(pod)
+	}
+	wg.Wait()
+	s.mu.Lock()
+	s.lastPoll = time.Now().UTC()
+	s.mu.Unlock()
+	progress := s.progress()
+	connectionsReady.Set(float64(progress.Ready))
+	s.logger().Info("polling summary", "pods", progress.Pods, "podsReporting", progress.PodsReporting, "ready", progress.Ready, "total", progress.Total)
+	saveState()
+}
+
+// Return how many of the expected connection tests client pods reached so far
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(s.progress()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
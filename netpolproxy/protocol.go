@@ -0,0 +1,21 @@
+package main
+
+import (
+	"example.com/netpolprotocol"
+)
+
+// Types exchanged with kube-burner and the client pods
+type (
+	connection      = netpolprotocol.Connection
+	connTest        = netpolprotocol.ConnTest
+	initiateRequest = netpolprotocol.InitiateRequest
+	ProxyResponse   = netpolprotocol.ProxyResponse
+	resultsReport   = netpolprotocol.ResultsReport
+	reportResponse  = netpolprotocol.ReportResponse
+	errorResponse   = netpolprotocol.ErrorResponse
+)
+
+const (
+	legacySchemaVersion = netpolprotocol.LegacySchemaVersion
+	latestSchemaVersion = netpolprotocol.LatestSchemaVersion
+)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"example.com/netpolprotocol"
+)
+
+// A compressing ProxyClient drives a session of client pods old and new:
+// results with connectionidx end up with their ingressidx in /results
+func TestProxyClientContract(t *testing.T) {
+	legacy := newTestPod(t)
+	legacy.legacy = true
+	pods := map[string]*testPod{"pod-a": legacy, "pod-b": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	proxy.Compress = true
+	ctx := context.Background()
+	conns := map[string][]connection{
+		"pod-a": {
+			{Addresses: []string{"10.0.0.1"}, Ports: []int32{8080}, Netpol: "np1"},
+			{Addresses: []string{"10.0.0.2"}, Ports: []int32{8080, 65535}, Netpol: "np2"},
+		},
+		"pod-b": {
+			{Addresses: []string{"10.0.0.3"}, Ports: []int32{8443}, Netpol: "np1"},
+		},
+	}
+
+	session, err := proxy.Initiate(ctx, "contract", netpolprotocol.InitiateRequest{Netpols: []string{"np1", "np2"}, Connections: conns})
+	if err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	if session != "contract" {
+		t.Errorf("expected session contract, got %q", session)
+	}
+	waitConnectionsSent(t, proxy, session)
+
+	report := netpolprotocol.ResultsReport{
+		Pod:     "pod-b",
+		Session: session,
+		Results: []connTest{{Address: "10.0.0.3", Port: 8443, NpName: "np1", Timestamp: pods["pod-b"].reachedAt}},
+	}
+	resp, err := proxy.Report(ctx, report)
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if resp.Session != session || resp.Accepted != 1 {
+		t.Errorf("expected 1 result accepted in session %s, got %+v", session, resp)
+	}
+
+	if err := proxy.Stop(ctx, session); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, session)
+	results, err := proxy.Results(ctx, session)
+	if err != nil {
+		t.Fatalf("results: %v", err)
+	}
+	expectedResults(t, results, pods, conns)
+	var summary map[string]json.RawMessage
+	getJSON(t, proxy, "/summary?session="+session, &summary)
+	if !strings.Contains(string(summary["policies"]), `"np2"`) {
+		t.Errorf("expected the summary grouped by network policy, got %s", summary["policies"])
+	}
+}
+
+func TestProxyClientReachability(t *testing.T) {
+	pod := newTestPod(t)
+	pod.unreachable = map[string]bool{"10.0.0.2": true}
+	pods := map[string]*testPod{"pod-a": pod}
+	proxy := newTestProxy(t, pods)
+	proxy.Compress = true
+	ctx := context.Background()
+	req := netpolprotocol.ReachabilityRequest{Targets: map[string][]netpolprotocol.Target{
+		"pod-a": {
+			{Addresses: []string{"10.0.0.1"}, Ports: []int32{8080, 8443}, Group: "svc1"},
+			{Addresses: []string{"10.0.0.2"}, Ports: []int32{80}, Group: "svc2"},
+		},
+	}}
+
+	session, err := proxy.InitiateReachability(ctx, "", req)
+	if err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	waitConnectionsSent(t, proxy, session)
+	pods["pod-a"].mu.Lock()
+	path := pods["pod-a"].path
+	pods["pod-a"].mu.Unlock()
+	if path != "/reach" {
+		t.Errorf("expected targets delivered to /reach, got %s", path)
+	}
+	report := netpolprotocol.ResultsReport{
+		Pod:     "pod-a",
+		Reached: []netpolprotocol.ReachResult{{Address: "10.0.0.1", Port: 8080, Group: "svc1", Timestamp: pod.reachedAt}},
+	}
+	if resp, err := proxy.Report(ctx, report); err != nil || resp.Accepted != 1 {
+		t.Errorf("expected the pushed target accepted, got %+v, %v", resp, err)
+	}
+	if err := proxy.Stop(ctx, session); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, session)
+	results, err := proxy.ReachResults(ctx, session)
+	if err != nil {
+		t.Fatalf("results: %v", err)
+	}
+	if res := results["pod-a"]; len(res) != 2 || res[0].Group != "svc1" || res[0].TargetIdx != 0 || res[0].Port != 8080 || res[0].CorrectedTimestamp == nil {
+		t.Errorf("expected the targets of group svc1 reached, got %+v", results)
+	}
+
+	// summaries, missing results and exports are grouped by target group
+	var summary map[string]json.RawMessage
+	getJSON(t, proxy, "/summary?session="+session, &summary)
+	if _, ok := summary["policies"]; ok || !strings.Contains(string(summary["groups"]), `"svc1"`) {
+		t.Errorf("expected the summary grouped by target group, got %s", summary["groups"])
+	}
+	var missing struct {
+		Missing int                          `json:"missing"`
+		Pods    []map[string]json.RawMessage `json:"pods"`
+	}
+	getJSON(t, proxy, "/missing?session="+session, &missing)
+	if missing.Missing != 1 || len(missing.Pods) != 1 || !strings.Contains(string(missing.Pods[0]["groups"]), `"svc2"`) {
+		t.Errorf("expected the unreached target of group svc2 missing, got %+v", missing)
+	}
+	resp, err := http.Get(proxy.BaseURL + "/results?format=csv&group=svc1&session=" + session)
+	if err != nil {
+		t.Fatalf("results: %v", err)
+	}
+	defer resp.Body.Close()
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("decode csv: %v", err)
+	}
+	if len(rows) != 3 || rows[0][3] != "targetidx" || rows[0][4] != "group" || rows[1][4] != "svc1" {
+		t.Errorf("expected the targets of group svc1 with target columns, got %v", rows)
+	}
+}
+
+func getJSON(t *testing.T, proxy *netpolprotocol.ProxyClient, path string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(proxy.BaseURL + path)
+	if err != nil {
+		t.Fatalf("get %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get %s: status %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decode %s: %v", path, err)
+	}
+}
+
+func TestProxyClientInvalidPayload(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+	req := netpolprotocol.InitiateRequest{
+		Netpols: []string{"np1"},
+		Connections: map[string][]connection{
+			"pod-a": {{Addresses: []string{"10.0.0.1"}, Ports: []int32{8080}, Netpol: "np2"}},
+		},
+	}
+	_, err := proxy.Initiate(context.Background(), "", req)
+	var statusErr *netpolprotocol.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v", err)
+	}
+	if statusErr.Response == nil || len(statusErr.Response.Details) != 1 || !strings.Contains(statusErr.Response.Details[0], `"np2"`) {
+		t.Errorf("expected the unknown network policy in the details, got %+v", statusErr.Response)
+	}
+	if registry.getCurrent() != nil {
+		t.Error("expected no session started by an invalid payload")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// How results get from client pods to the proxy after /stop
+const (
+	// the proxy retrieves results from every client pod
+	resultsModePull = "pull"
+	// client pods push results to /report, the proxy waits for their final batch
+	resultsModePush = "push"
+)
+
+// in push mode, results are pulled from client pods which didn't push their
+// final batch this long after /stop, e.g. because some of their connections
+// never became reachable
+const defaultReportWait = 30 * time.Second
+
+var (
+	resultsMode = resultsModePull
+	reportWait  = defaultReportWait
+)
+
+// Wake up waitForReports, without blocking when it is not waiting
+func (s *session) notifyReport() {
+	select {
+	case s.reports <- struct{}{}:
+	default:
+	}
+}
+
+// Accept a batch of results pushed by a client pod. The pod defaults to the
+// address the request comes from with the direct resolver, it is required
+// with the others, and the session defaults to the current one.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	body, err := netpolprotocol.RequestBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var report resultsReport
+	if err := json.NewDecoder(body).Decode(&report); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid report: %v", err))
+		return
+	}
+	body.Close()
+	if report.Pod == "" {
+		if podClient.Resolver != nil {
+			// pod keys are pod names, which the address of the request doesn't tell
+			writeError(w, http.StatusBadRequest, "invalid report: pod required when client pods are reached by name, set POD_NAME on client pods")
+			return
+		}
+		report.Pod, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	var s *session
+	if report.Session == "" {
+		s = registry.getCurrent()
+	} else {
+		s, _ = registry.get(report.Session)
+	}
+	if s == nil {
+		writeError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	if _, ok := s.connections[report.Pod]; !ok {
+		msg := fmt.Sprintf("pod %q is not part of session %s", report.Pod, s.ID)
+		if podClient.Resolver != nil {
+			msg += ", client pods reached by name must report their name, set POD_NAME on client pods"
+		}
+		writeError(w, http.StatusNotFound, msg)
+		return
+	}
+	if s.resultsCollected() {
+		writeError(w, http.StatusConflict, fmt.Sprintf("results of session %s are already collected", s.ID))
+		return
+	}
+	added := s.mergeResults(report.Pod, s.workloadType().reportedResults(&report))
+	for _, res := range added {
+		resultsCollected.WithLabelValues(res.NpName).Inc()
+	}
+	if report.Final {
+		alreadyCollected := false
+		s.updatePodStatus(report.Pod, func(ps *podStatus) {
+			alreadyCollected = ps.Collection == statusCollected
+			ps.Collection = statusCollected
+			ps.CollectionError = ""
+		})
+		if !alreadyCollected {
+			podsCollected.Inc()
+			s.podLogger(report.Pod).Debug("final results reported")
+		}
+		s.notifyReport()
+	} else {
+		saveState()
+	}
+	if err := json.NewEncoder(w).Encode(reportResponse{Session: s.ID, Accepted: len(added)}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Wait until every client pod pushed its final batch of results, or until ctx
+// is done. Pods which never got their connections have nothing to report and
+// are marked as failed right away. Returns the number of pods which didn't
+// push their final batch.
+func (s *session) waitForReports(ctx context.Context) int {
+	for {
+		pending := 0
+		for pod := range s.connections {
+			ps := s.getPodStatus(pod)
+			switch {
+			case ps.Collection == statusCollected || ps.Collection == statusFailed:
+			case ps.Delivery == statusFailed:
+				podsFailed.WithLabelValues("collection").Inc()
+				s.updatePodStatus(pod, func(ps *podStatus) {
+					ps.Collection = statusFailed
+					ps.CollectionError = "connections were never delivered"
+				})
+			default:
+				pending++
+			}
+		}
+		if pending == 0 {
+			return 0
+		}
+		s.logger().Info("waiting for final results", "pendingPods", pending)
+		select {
+		case <-s.reports:
+		case <-ctx.Done():
+			return pending
+		}
+	}
+}
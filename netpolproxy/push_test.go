@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Use push mode, waiting wait for final results, for the duration of the test
+func usePushMode(t *testing.T, wait time.Duration) {
+	resultsMode, reportWait = resultsModePush, wait
+	t.Cleanup(func() {
+		resultsMode, reportWait = resultsModePull, defaultReportWait
+	})
+}
+
+func TestPushWithoutFinalReport(t *testing.T) {
+	usePushMode(t, 100*time.Millisecond)
+	pods := map[string]*testPod{"pod-a": newTestPod(t), "pod-b": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	conns := testConnections(pods)
+	if _, err := proxy.Initiate(ctx, "", netpolprotocol.InitiateRequest{Connections: conns}); err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	waitConnectionsSent(t, proxy, "")
+
+	// pod-a reached all its connections, pod-b is still waiting for one of them
+	reached := time.Now().UTC()
+	var resultsA, resultsB []connTest
+	for _, port := range conns["pod-a"][0].Ports {
+		resultsA = append(resultsA, connTest{Address: conns["pod-a"][0].Addresses[0], Port: int(port), NpName: conns["pod-a"][0].Netpol, Timestamp: reached})
+	}
+	resultsB = append(resultsB, connTest{Address: conns["pod-b"][0].Addresses[0], Port: int(conns["pod-b"][0].Ports[0]), NpName: conns["pod-b"][0].Netpol, Timestamp: reached})
+	if _, err := proxy.Report(ctx, netpolprotocol.ResultsReport{Pod: "pod-a", Results: resultsA, Final: true}); err != nil {
+		t.Fatalf("report pod-a: %v", err)
+	}
+	if _, err := proxy.Report(ctx, netpolprotocol.ResultsReport{Pod: "pod-b", Results: resultsB}); err != nil {
+		t.Fatalf("report pod-b: %v", err)
+	}
+
+	if err := proxy.Stop(ctx, ""); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if status := waitResultsCollected(t, proxy, ""); status.Partial {
+		t.Errorf("expected results of all pods, got %+v", status)
+	}
+	if _, pulls := pods["pod-a"].requests(); pulls != 0 {
+		t.Errorf("expected no pull from pod-a, which pushed its final results, got %d", pulls)
+	}
+	if _, pulls := pods["pod-b"].requests(); pulls != 1 {
+		t.Errorf("expected results of pod-b to be pulled, got %d pulls", pulls)
+	}
+	results, err := proxy.Results(ctx, "")
+	if err != nil {
+		t.Fatalf("results: %v", err)
+	}
+	if len(results["pod-a"]) != 2 || len(results["pod-b"]) != 2 {
+		t.Errorf("expected 2 results of each pod, got %+v", results)
+	}
+}
+
+// Client pods reached by name must report their name, the address of the
+// request can't be mapped back to it
+func TestReportByName(t *testing.T) {
+	pods := map[string]*testPod{"pod-a": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	conns := testConnections(pods)
+	if _, err := proxy.Initiate(ctx, "", netpolprotocol.InitiateRequest{Connections: conns}); err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	waitConnectionsSent(t, proxy, "")
+	results := []connTest{{Address: conns["pod-a"][0].Addresses[0], Port: int(conns["pod-a"][0].Ports[0]), NpName: conns["pod-a"][0].Netpol, Timestamp: time.Now().UTC()}}
+
+	var statusErr *netpolprotocol.StatusError
+	if _, err := proxy.Report(ctx, netpolprotocol.ResultsReport{Results: results}); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a report without pod, got %v", err)
+	}
+	if _, err := proxy.Report(ctx, netpolprotocol.ResultsReport{Pod: "127.0.0.1", Results: results}); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound || !strings.Contains(statusErr.Response.Error, "POD_NAME") {
+		t.Errorf("expected 404 pointing at POD_NAME for a report by IP, got %v", err)
+	}
+	resp, err := proxy.Report(ctx, netpolprotocol.ResultsReport{Pod: "pod-a", Results: results})
+	if err != nil || resp.Accepted != 1 {
+		t.Errorf("expected the report of pod-a accepted, got %+v, %v", resp, err)
+	}
+
+	if err := proxy.Stop(ctx, ""); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, "")
+}
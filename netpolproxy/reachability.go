@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// HTTP reachability: client pods get targets on /reach, test them right away
+// rather than waiting for the job to create its objects, and report when they
+// first reached each of them as ReachResults, e.g. to measure when services
+// become ready. Results are grouped by the group of their target, held as the
+// npname of connection tests by the proxy.
+type reachabilityWorkload struct{}
+
+func init() {
+	registerWorkload(netpolprotocol.WorkloadHTTP, reachabilityWorkload{})
+}
+
+func (reachabilityWorkload) decode(body []byte) (*initiateRequest, error) {
+	var payload netpolprotocol.ReachabilityRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("invalid %s workload payload: %v", netpolprotocol.WorkloadHTTP, err)
+	}
+	req := &initiateRequest{
+		SchemaVersion: latestSchemaVersion,
+		Connections:   make(map[string][]connection, len(payload.Targets)),
+	}
+	for pod, targets := range payload.Targets {
+		conns := make([]connection, 0, len(targets))
+		for _, target := range targets {
+			conns = append(conns, connection{Addresses: target.Addresses, Ports: target.Ports, Netpol: target.Group})
+		}
+		req.Connections[pod] = conns
+	}
+	return req, nil
+}
+
+func (reachabilityWorkload) validate(req *initiateRequest) []string {
+	return limitErrors(connectionErrors(req.Connections, "group", nil))
+}
+
+func (reachabilityWorkload) deliveryPath() string {
+	return "/reach"
+}
+
+func (reachabilityWorkload) streamResults(ctx context.Context, pod string, batchSize int, fn func(batch []connTest) error) error {
+	converted := make([]connTest, 0, batchSize)
+	return podClient.StreamReachResults(ctx, pod, batchSize, func(batch []netpolprotocol.ReachResult) error {
+		converted = converted[:0]
+		for _, res := range batch {
+			converted = append(converted, fromReachResult(res))
+		}
+		return fn(converted)
+	})
+}
+
+func (reachabilityWorkload) reportedResults(report *resultsReport) []connTest {
+	results := make([]connTest, 0, len(report.Reached))
+	for _, res := range report.Reached {
+		results = append(results, fromReachResult(res))
+	}
+	return results
+}
+
+// A reachability result of a client pod, one line of NDJSON and CSV exports
+type reachRow struct {
+	Pod string `json:"pod,omitempty"`
+	netpolprotocol.ReachResult
+}
+
+func (reachabilityWorkload) encodeResult(pod string, res connTest) interface{} {
+	return reachRow{Pod: pod, ReachResult: netpolprotocol.ReachResult{
+		Address:            res.Address,
+		Port:               res.Port,
+		TargetIdx:          res.IngressIdx,
+		Group:              res.NpName,
+		Timestamp:          res.Timestamp,
+		CorrectedTimestamp: res.CorrectedTimestamp,
+	}}
+}
+
+// Targets have no creation time, latencies are measured from the session
+// start or since
+func (reachabilityWorkload) latencyReference(s *session, group string) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (reachabilityWorkload) grouping() grouping {
+	return grouping{key: "groups", column: "group", index: "targetidx"}
+}
+
+func fromReachResult(res netpolprotocol.ReachResult) connTest {
+	return connTest{
+		Address:            res.Address,
+		Port:               res.Port,
+		IngressIdx:         res.TargetIdx,
+		NpName:             res.Group,
+		Timestamp:          res.Timestamp,
+		CorrectedTimestamp: res.CorrectedTimestamp,
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// How the pod keys of connections map to client pods
+const (
+	// keys are pod IPs or host names the proxy can reach, the historical behavior
+	resolverDirect = "direct"
+	// keys are pod names, reached as <pod>.<POD_DNS_SUFFIX>
+	resolverDNS = "dns"
+	// keys are pod names, looked up in the SRV records of a headless service
+	resolverSRV = "srv"
+
+	// SRV records are looked up again after this duration, or when a pod is
+	// missing from them but not more often than srvMinRefreshInterval
+	srvRefreshInterval    = 30 * time.Second
+	srvMinRefreshInterval = 2 * time.Second
+)
+
+// Reach client pods through their DNS name, e.g. with a headless service
+// named after the subdomain of the client pods:
+// <pod>.<subdomain>.<namespace>.svc.cluster.local
+type dnsResolver struct {
+	suffix string
+	port   int
+}
+
+func (r *dnsResolver) Resolve(ctx context.Context, pod string) (string, error) {
+	host := pod
+	if r.suffix != "" {
+		host = pod + "." + r.suffix
+	}
+	return net.JoinHostPort(host, strconv.Itoa(r.port)), nil
+}
+
+// Map pod names to the endpoints of a headless service, from its SRV records,
+// e.g. _http._tcp.<service>.<namespace>.svc.cluster.local. Targets of these
+// records are named after the hostname of the pod, or after its IP with
+// dashes when the pod has no hostname. Pod keys are matched against the first
+// label of the targets, so they are either hostnames, which can't contain
+// dots, or pod IPs.
+type srvResolver struct {
+	name string
+	// net.DefaultResolver.LookupSRV, replaced in tests
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+	mu          sync.Mutex
+	endpoints   map[string]string
+	refreshedAt time.Time
+	// closed once the refresh in progress completes, nil when there is none
+	refreshing chan struct{}
+	refreshErr error
+}
+
+func newSRVResolver(name string) *srvResolver {
+	return &srvResolver{name: name, lookupSRV: net.DefaultResolver.LookupSRV, endpoints: make(map[string]string)}
+}
+
+func (r *srvResolver) Resolve(ctx context.Context, pod string) (string, error) {
+	key, err := srvTargetLabel(pod)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	endpoint, ok := r.endpoints[key]
+	sinceRefresh := time.Since(r.refreshedAt)
+	if (ok || sinceRefresh < srvMinRefreshInterval) && sinceRefresh < srvRefreshInterval {
+		r.mu.Unlock()
+		return r.found(pod, endpoint, ok)
+	}
+	// records are looked up without holding r.mu so that workers delivering to
+	// known pods aren't held up, and once for all the callers missing a pod
+	done := r.refreshing
+	if done == nil {
+		done = make(chan struct{})
+		r.refreshing = done
+		r.mu.Unlock()
+		endpoints, err := r.lookup(ctx)
+		r.mu.Lock()
+		if err == nil {
+			r.endpoints = endpoints
+		}
+		r.refreshedAt, r.refreshErr, r.refreshing = time.Now(), err, nil
+		close(done)
+	} else if ok {
+		// keep using the last known endpoint while another caller refreshes
+		r.mu.Unlock()
+		return endpoint, nil
+	} else {
+		r.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		r.mu.Lock()
+	}
+	defer r.mu.Unlock()
+	if r.refreshErr != nil {
+		if ok {
+			// keep using the last known endpoint
+			return endpoint, nil
+		}
+		return "", r.refreshErr
+	}
+	endpoint, ok = r.endpoints[key]
+	return r.found(pod, endpoint, ok)
+}
+
+func (r *srvResolver) found(pod, endpoint string, ok bool) (string, error) {
+	if !ok {
+		return "", fmt.Errorf("no SRV record of %s for pod %s", r.name, pod)
+	}
+	return endpoint, nil
+}
+
+// Look up the SRV records, keyed by the first label of their target
+func (r *srvResolver) lookup(ctx context.Context) (map[string]string, error) {
+	_, records, err := r.lookupSRV(ctx, "", "", r.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV records of %s: %v", r.name, err)
+	}
+	endpoints := make(map[string]string, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		label, _, _ := strings.Cut(target, ".")
+		endpoints[label] = net.JoinHostPort(target, strconv.Itoa(int(record.Port)))
+	}
+	return endpoints, nil
+}
+
+// Return the label SRV targets carry for pod: its IP with dashes, or its
+// hostname, which must be a single DNS label
+func srvTargetLabel(pod string) (string, error) {
+	if ip := net.ParseIP(pod); ip != nil {
+		sep := "."
+		if ip.To4() == nil {
+			sep = ":"
+		}
+		return strings.ReplaceAll(pod, sep, "-"), nil
+	}
+	if pod == "" || strings.Contains(pod, ".") {
+		return "", fmt.Errorf("pod key %q is neither a pod IP nor a hostname without dots, as named in SRV targets", pod)
+	}
+	return pod, nil
+}
+
+// Build the resolver of client pods, nil for direct resolution
+func newPodResolver(kind, dnsSuffix, srvName string) (netpolprotocol.Resolver, error) {
+	switch kind {
+	case resolverDirect:
+		return nil, nil
+	case resolverDNS:
+		return &dnsResolver{suffix: strings.Trim(dnsSuffix, "."), port: podPort}, nil
+	case resolverSRV:
+		if srvName == "" {
+			return nil, fmt.Errorf("SRV record name required")
+		}
+		return newSRVResolver(srvName), nil
+	}
+	return nil, fmt.Errorf("unknown pod resolver %q, use %s, %s or %s", kind, resolverDirect, resolverDNS, resolverSRV)
+}
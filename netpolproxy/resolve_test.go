@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// SRV lookups of a headless service answering with targets, blocking while
+// block is set
+type fakeSRV struct {
+	targets []string
+	lookups atomic.Int32
+
+	mu    sync.Mutex
+	block chan struct{}
+}
+
+func (f *fakeSRV) lookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.lookups.Add(1)
+	f.mu.Lock()
+	block, targets := f.block, f.targets
+	f.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	records := make([]*net.SRV, 0, len(targets))
+	for _, target := range targets {
+		records = append(records, &net.SRV{Target: target + ".clients.ns.svc.cluster.local.", Port: 9001})
+	}
+	return name, records, nil
+}
+
+func newTestSRVResolver(targets ...string) (*srvResolver, *fakeSRV) {
+	f := &fakeSRV{targets: targets}
+	r := newSRVResolver("_http._tcp.clients.ns.svc.cluster.local")
+	r.lookupSRV = f.lookupSRV
+	return r, f
+}
+
+func TestSRVResolverKeys(t *testing.T) {
+	r, _ := newTestSRVResolver("client-0", "10-128-0-5", "fd00--5")
+	for _, tc := range []struct {
+		pod  string
+		want string
+	}{
+		{"client-0", "client-0.clients.ns.svc.cluster.local:9001"},
+		{"10.128.0.5", "10-128-0-5.clients.ns.svc.cluster.local:9001"},
+		{"10-128-0-5", "10-128-0-5.clients.ns.svc.cluster.local:9001"},
+		{"fd00::5", "fd00--5.clients.ns.svc.cluster.local:9001"},
+		// a pod name with dots can't be the hostname of a target
+		{"client.0", ""},
+		{"client-1", ""},
+	} {
+		endpoint, err := r.Resolve(context.Background(), tc.pod)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, resolved to %s", tc.pod, endpoint)
+			}
+			continue
+		}
+		if err != nil || endpoint != tc.want {
+			t.Errorf("%s: expected %s, got %q, %v", tc.pod, tc.want, endpoint, err)
+		}
+	}
+}
+
+// Known pods resolve while records are looked up again, pods missing from
+// the records wait for the lookup in progress
+func TestSRVResolverRefresh(t *testing.T) {
+	r, f := newTestSRVResolver("client-0")
+	ctx := context.Background()
+	if _, err := r.Resolve(ctx, "client-0"); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	block := make(chan struct{})
+	f.mu.Lock()
+	f.block, f.targets = block, []string{"client-0", "client-1"}
+	f.mu.Unlock()
+	r.mu.Lock()
+	r.refreshedAt = time.Now().Add(-srvRefreshInterval)
+	r.mu.Unlock()
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := r.Resolve(ctx, "client-0")
+		refreshed <- err
+	}()
+	waitFor(t, "the lookup to start", func() (bool, error) { return f.lookups.Load() == 2, nil })
+
+	resolved := make(chan error, 1)
+	go func() {
+		_, err := r.Resolve(ctx, "client-0")
+		resolved <- err
+	}()
+	select {
+	case err := <-resolved:
+		if err != nil {
+			t.Errorf("expected the known endpoint during the lookup, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("resolving a known pod waited for the lookup")
+	}
+	missing := make(chan error, 1)
+	go func() {
+		_, err := r.Resolve(ctx, "client-1")
+		missing <- err
+	}()
+	select {
+	case err := <-missing:
+		t.Fatalf("expected the missing pod to wait for the lookup, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(block)
+	if err := <-refreshed; err != nil {
+		t.Errorf("refresh: %v", err)
+	}
+	if err := <-missing; err != nil {
+		t.Errorf("expected the missing pod found by the lookup, got %v", err)
+	}
+	if n := f.lookups.Load(); n != 2 {
+		t.Errorf("expected a lookup at start and a single one for both callers, got %d lookups", n)
+	}
+}
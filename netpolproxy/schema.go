@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Number of validation errors reported back to kube-burner
+const maxValidationErrors = 20
+
+// Proxy version, set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+var dnsNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?)*$`)
+
+type versionResponse struct {
+	Version          string   `json:"version"`
+	SchemaVersions   []int    `json:"schemaVersions"`
+	PreferredVersion int      `json:"preferredSchemaVersion"`
+	Workloads        []string `json:"workloads"`
+	// whether /initiate starts a new session right now, and why not
+	AcceptingInitiate bool   `json:"acceptingInitiate"`
+	Reason            string `json:"reason,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, msg string, details ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg, Details: details})
+}
+
+// Wrap handler to reply 405 to methods other than methods
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed, use %s", r.Method, strings.Join(methods, " or ")))
+	}
+}
+
+// Return the proxy version, the /initiate schema versions and the workload
+// types it accepts
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	response := versionResponse{
+		Version:          version,
+		SchemaVersions:   []int{legacySchemaVersion, latestSchemaVersion},
+		PreferredVersion: latestSchemaVersion,
+		Workloads:        workloadNames(),
+	}
+	response.AcceptingInitiate, response.Reason = acceptingInitiate()
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Decode an /initiate payload of any supported schema version. A payload with
+// a schemaVersion key is an envelope, anything else is a legacy payload.
+func decodeInitiate(body []byte) (*initiateRequest, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("payload is not a JSON object: %v", err)
+	}
+	if _, ok := raw["schemaVersion"]; !ok {
+		req := &initiateRequest{SchemaVersion: legacySchemaVersion}
+		if err := json.Unmarshal(body, &req.Connections); err != nil {
+			return nil, fmt.Errorf("invalid schema version %d payload: %v", legacySchemaVersion, err)
+		}
+		return req, nil
+	}
+	var req initiateRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid schema version %d payload: %v", latestSchemaVersion, err)
+	}
+	if req.SchemaVersion != latestSchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d, supported versions are %d and %d", req.SchemaVersion, legacySchemaVersion, latestSchemaVersion)
+	}
+	return &req, nil
+}
+
+func isValidHost(host string) bool {
+	return net.ParseIP(host) != nil || (len(host) <= 253 && dnsNameRegexp.MatchString(host))
+}
+
+// Return the problems found in the payload, at most maxValidationErrors of
+// them. An empty list means the payload is valid.
+func validateInitiate(req *initiateRequest) []string {
+	var errs []string
+	known := make(map[string]bool)
+	for _, np := range req.Netpols {
+		if np == "" {
+			errs = append(errs, "netpols: empty network policy name")
+		}
+		known[np] = true
+	}
+	if len(req.Netpols) == 0 {
+		known = nil
+	}
+	for np, created := range req.NetpolCreated {
+		if np == "" {
+			errs = append(errs, "netpolCreated: empty network policy name")
+		} else if known != nil && !known[np] {
+			errs = append(errs, fmt.Sprintf("netpolCreated: unknown network policy %q", np))
+		}
+		if created.IsZero() {
+			errs = append(errs, fmt.Sprintf("netpolCreated: no creation time for network policy %q", np))
+		}
+	}
+	errs = append(errs, connectionErrors(req.Connections, "network policy", known)...)
+	return limitErrors(errs)
+}
+
+// Return the problems found in the connections of every client pod, common
+// to all workload types. group names what connections are grouped by, e.g.
+// network policy, and known lists the valid group names, any when nil.
+func connectionErrors(conns map[string][]connection, group string, known map[string]bool) []string {
+	var errs []string
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	if len(conns) == 0 {
+		addErr("no client pods")
+	}
+	for pod, podConns := range conns {
+		if !isValidHost(pod) {
+			addErr("pod %q: not an IP address or DNS name", pod)
+		}
+		if len(podConns) == 0 {
+			addErr("pod %q: no connections", pod)
+		}
+		for i, conn := range podConns {
+			if len(conn.Addresses) == 0 {
+				addErr("pod %q connection %d: no addresses", pod, i)
+			}
+			for _, address := range conn.Addresses {
+				if !isValidHost(address) {
+					addErr("pod %q connection %d: address %q is not an IP address or DNS name", pod, i, address)
+				}
+			}
+			if len(conn.Ports) == 0 {
+				addErr("pod %q connection %d: no ports", pod, i)
+			}
+			for _, port := range conn.Ports {
+				if port < 1 || port > 65535 {
+					addErr("pod %q connection %d: invalid port %d", pod, i, port)
+				}
+			}
+			if conn.Netpol == "" {
+				addErr("pod %q connection %d: empty %s name", pod, i, group)
+			} else if known != nil && !known[conn.Netpol] {
+				addErr("pod %q connection %d: unknown %s %q", pod, i, group, conn.Netpol)
+			}
+		}
+	}
+	return errs
+}
+
+// Sort errs and keep at most maxValidationErrors of them
+func limitErrors(errs []string) []string {
+	sort.Strings(errs)
+	if len(errs) > maxValidationErrors {
+		errs = append(errs[:maxValidationErrors], fmt.Sprintf("... and %d more", len(errs)-maxValidationErrors))
+	}
+	return errs
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Phase of a session. A session moves forward only:
+//
+//	idle -> distributing -> distributed -> collecting -> collected
+//
+// A /stop received before connections are distributed is remembered and
+// collection starts as soon as distribution completes.
+type phase int
+
+const (
+	phaseIdle phase = iota
+	phaseDistributing
+	phaseDistributed
+	phaseCollecting
+	phaseCollected
+)
+
+var phaseNames = []string{"idle", "distributing", "distributed", "collecting", "collected"}
+
+func (p phase) String() string {
+	if p < phaseIdle || p > phaseCollected {
+		return fmt.Sprintf("phase(%d)", int(p))
+	}
+	return phaseNames[p]
+}
+
+func (p phase) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *phase) UnmarshalText(text []byte) error {
+	for i, name := range phaseNames {
+		if name == string(text) {
+			*p = phase(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown phase %q", text)
+}
+
+// A session is one kube-burner job of a workload type: the connections
+// received on /initiate, their delivery to client pods and the results
+// collected from them after /stop. The proxy runs one session at a time, a
+// new session can be initiated once results of the current one are collected.
+//
+// ID, StartTime, Workload, connections and netpolCreated never change once
+// the session is created, everything else is guarded by mu and only accessed
+// through the methods below.
+type session struct {
+	ID          string
+	StartTime   time.Time
+	Workload    string
+	connections map[string][]connection
+	// creation time of network policies sent on /initiate, if any
+	netpolCreated map[string]time.Time
+
+	mu             sync.Mutex
+	phase          phase
+	stopRequested  bool
+	clusterResults map[string][]connTest
+	podStatuses    map[string]*podStatus
+	// last time partial results were pulled from client pods
+	lastPoll time.Time
+
+	connWg sync.WaitGroup
+	resWg  sync.WaitGroup
+	// signaled when a client pod pushes its final results
+	reports chan struct{}
+}
+
+// Summary of a session returned by /sessions
+type sessionInfo struct {
+	ID               string    `json:"id"`
+	StartTime        time.Time `json:"startTime"`
+	Workload         string    `json:"workload"`
+	Current          bool      `json:"current"`
+	Phase            phase     `json:"phase"`
+	Pods             int       `json:"pods"`
+	ConnectionsSent  bool      `json:"connectionsSent"`
+	StopRequested    bool      `json:"stopRequested"`
+	ResultsCollected bool      `json:"resultsCollected"`
+	DeliveryFailed   int       `json:"deliveryFailed"`
+	CollectionFailed int       `json:"collectionFailed"`
+}
+
+func newSession(id, workload string, conns map[string][]connection) *session {
+	if conns == nil {
+		conns = make(map[string][]connection)
+	}
+	return &session{
+		ID:             id,
+		StartTime:      time.Now().UTC(),
+		Workload:       workload,
+		connections:    conns,
+		clusterResults: make(map[string][]connTest),
+		podStatuses:    make(map[string]*podStatus),
+		reports:        make(chan struct{}, 1),
+	}
+}
+
+func (s *session) getPhase() phase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phase
+}
+
+// Move the session from phase from to phase to, failing if it is in another phase
+func (s *session) transition(from, to phase) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.phase != from {
+		return fmt.Errorf("session %s: cannot move to %v, phase is %v instead of %v", s.ID, to, s.phase, from)
+	}
+	s.phase = to
+	return nil
+}
+
+// Record a /stop. Returns whether the stop was already requested and whether
+// the caller has to start collecting results, i.e. connections are distributed.
+func (s *session) requestStop() (already, collect bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopRequested {
+		return true, false
+	}
+	s.stopRequested = true
+	if s.phase == phaseDistributed {
+		s.phase = phaseCollecting
+		return false, true
+	}
+	return false, false
+}
+
+// Mark connections as distributed. Returns whether the caller has to start
+// collecting results, i.e. /stop was requested during distribution.
+func (s *session) finishDistribution() (collect bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phaseDistributed
+	if s.stopRequested {
+		s.phase = phaseCollecting
+		return true
+	}
+	return false
+}
+
+func (s *session) connectionsSent() bool {
+	return s.getPhase() >= phaseDistributed
+}
+
+func (s *session) resultsCollected() bool {
+	return s.getPhase() == phaseCollected
+}
+
+// Resume the session where it stopped: distribute connections if it is idle
+// and collect results if /stop was requested once they are distributed.
+// Polling resumes until results are collected.
+func (s *session) resume() {
+	phase := s.getPhase()
+	switch phase {
+	case phaseIdle:
+		go s.sendConnections()
+	case phaseCollecting:
+		go s.getResults()
+	}
+	if pollInterval > 0 && phase < phaseCollecting {
+		go s.pollResults()
+	}
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	info := sessionInfo{
+		ID:               s.ID,
+		StartTime:        s.StartTime,
+		Workload:         s.Workload,
+		Phase:            s.phase,
+		Pods:             len(s.connections),
+		ConnectionsSent:  s.phase >= phaseDistributed,
+		StopRequested:    s.stopRequested,
+		ResultsCollected: s.phase == phaseCollected,
+	}
+	s.mu.Unlock()
+	info.DeliveryFailed = len(s.failedPods(false))
+	info.CollectionFailed = len(s.failedPods(true))
+	return info
+}
+
+// Number of sessions kept, completed sessions past it are dropped oldest
+// first, 0 keeps them all
+var maxSessions = defaultMaxSessions
+
+const defaultMaxSessions = 10
+
+// Sessions known to the proxy, in creation order, and the current one
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	ids      []string
+	current  *session
+	// sessions created since start, so that numeric IDs of dropped sessions aren't reused
+	created int
+}
+
+var registry = newSessionRegistry()
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+// Register s as the current session, callers hold r.mu
+func (r *sessionRegistry) add(s *session) {
+	r.sessions[s.ID] = s
+	r.ids = append(r.ids, s.ID)
+	r.current = s
+	r.created++
+}
+
+// Drop the oldest sessions past maxSessions, never the current one, callers hold r.mu
+func (r *sessionRegistry) evict() {
+	if maxSessions <= 0 {
+		return
+	}
+	for i := 0; len(r.ids) > maxSessions && i < len(r.ids); {
+		id := r.ids[i]
+		if r.sessions[id] == r.current {
+			i++
+			continue
+		}
+		delete(r.sessions, id)
+		r.ids = append(r.ids[:i], r.ids[i+1:]...)
+		slog.Debug("dropped session", "session", id, "maxSessions", maxSessions)
+	}
+}
+
+// Return the first unused numeric session ID, callers hold r.mu
+func (r *sessionRegistry) nextID() string {
+	for n := r.created + 1; ; n++ {
+		id := strconv.Itoa(n)
+		if _, ok := r.sessions[id]; !ok {
+			return id
+		}
+	}
+}
+
+// Create and register a new current session of workload with id, or the next
+// numeric ID when id is empty, from the decoded /initiate payload req. Fails
+// while the current session is running or when id is taken.
+func (r *sessionRegistry) start(id, workload string, req *initiateRequest) (*session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != nil && !r.current.resultsCollected() {
+		return nil, fmt.Errorf("session %s is still running, it must be stopped first", r.current.ID)
+	}
+	if id == "" {
+		id = r.nextID()
+	} else if _, ok := r.sessions[id]; ok {
+		return nil, fmt.Errorf("session %q already exists", id)
+	}
+	s := newSession(id, workload, req.Connections)
+	s.netpolCreated = req.NetpolCreated
+	r.add(s)
+	r.evict()
+	return s, nil
+}
+
+func (r *sessionRegistry) getCurrent() *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+func (r *sessionRegistry) get(id string) (*session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// Return info of all sessions, oldest first
+func (r *sessionRegistry) list() []sessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]sessionInfo, 0, len(r.ids))
+	for _, id := range r.ids {
+		info := r.sessions[id].info()
+		info.Current = r.sessions[id] == r.current
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Return the session requested with the session query parameter, or the
+// current session. Replies with 404 when there is no such session.
+func sessionFromRequest(w http.ResponseWriter, r *http.Request) *session {
+	id := r.URL.Query().Get("session")
+	if id == "" {
+		s := registry.getCurrent()
+		if s == nil {
+			writeError(w, http.StatusNotFound, "no session initiated")
+		}
+		return s
+	}
+	s, ok := registry.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("session %q not found", id))
+		return nil
+	}
+	return s
+}
+
+// List all sessions, oldest first
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(registry.list()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
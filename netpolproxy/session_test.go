@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Expected results of conns, reached by the pod at reachedAt
+func expectedResults(t *testing.T, results map[string][]connTest, pods map[string]*testPod, conns map[string][]connection) {
+	t.Helper()
+	if len(results) != len(pods) {
+		t.Fatalf("expected results of %d pods, got %d", len(pods), len(results))
+	}
+	for pod, podConns := range conns {
+		var expected []connTest
+		for i, conn := range podConns {
+			for _, address := range conn.Addresses {
+				for _, port := range conn.Ports {
+					expected = append(expected, connTest{Address: address, Port: int(port), IngressIdx: i, NpName: conn.Netpol, Timestamp: pods[pod].reachedAt})
+				}
+			}
+		}
+		got := results[pod]
+		for i := range got {
+			if got[i].CorrectedTimestamp == nil {
+				t.Errorf("pod %s result %d: expected a corrected timestamp", pod, i)
+			}
+			got[i].CorrectedTimestamp = nil
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("pod %s: expected results %+v, got %+v", pod, expected, got)
+		}
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	pods := map[string]*testPod{"pod-a": newTestPod(t), "pod-b": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	conns := testConnections(pods)
+
+	session, err := proxy.Initiate(ctx, "", netpolprotocol.InitiateRequest{Connections: conns})
+	if err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	if session != "1" {
+		t.Errorf("expected session 1, got %q", session)
+	}
+	if status := waitConnectionsSent(t, proxy, ""); status.Partial || len(status.FailedPods) > 0 {
+		t.Errorf("expected connections sent to all pods, got %+v", status)
+	}
+	for pod, p := range pods {
+		p.mu.Lock()
+		if !reflect.DeepEqual(p.conns, conns[pod]) {
+			t.Errorf("pod %s: expected connections %+v, got %+v", pod, conns[pod], p.conns)
+		}
+		p.mu.Unlock()
+	}
+
+	if err := proxy.Stop(ctx, ""); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if status := waitResultsCollected(t, proxy, ""); status.Partial || status.Session != "1" {
+		t.Errorf("expected results collected from all pods, got %+v", status)
+	}
+	results, err := proxy.Results(ctx, "")
+	if err != nil {
+		t.Fatalf("results: %v", err)
+	}
+	expectedResults(t, results, pods, conns)
+}
+
+func TestStopDuringDistribution(t *testing.T) {
+	slow := newTestPod(t)
+	slow.block = make(chan struct{})
+	pods := map[string]*testPod{"pod-a": newTestPod(t), "pod-b": slow}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	conns := testConnections(pods)
+
+	if _, err := proxy.Initiate(ctx, "", netpolprotocol.InitiateRequest{Connections: conns}); err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	waitFor(t, "delivery to pod-a", func() (bool, error) {
+		checks, _ := pods["pod-a"].requests()
+		return checks == 1, nil
+	})
+	if err := proxy.Stop(ctx, ""); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	status, err := proxy.StopStatus(ctx, "")
+	if err != nil {
+		t.Fatalf("stop status: %v", err)
+	}
+	if status.Result {
+		t.Error("expected results not to be collected while connections are sent")
+	}
+	if phase := registry.getCurrent().getPhase(); phase != phaseDistributing {
+		t.Errorf("expected phase %v while pod-b is blocked, got %v", phaseDistributing, phase)
+	}
+	for pod, p := range pods {
+		if _, pulls := p.requests(); pulls != 0 {
+			t.Errorf("pod %s: expected no results request before delivery completed, got %d", pod, pulls)
+		}
+	}
+
+	// the stop is remembered and results are collected once delivery completes
+	close(slow.block)
+	waitResultsCollected(t, proxy, "")
+	for pod, p := range pods {
+		if checks, pulls := p.requests(); checks != 1 || pulls != 1 {
+			t.Errorf("pod %s: expected 1 delivery and 1 collection, got %d and %d", pod, checks, pulls)
+		}
+	}
+	results, err := proxy.Results(ctx, "")
+	if err != nil {
+		t.Fatalf("results: %v", err)
+	}
+	expectedResults(t, results, pods, conns)
+}
+
+func TestInitiateConflict(t *testing.T) {
+	pods := map[string]*testPod{"pod-a": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	req := netpolprotocol.InitiateRequest{Connections: testConnections(pods)}
+
+	if _, err := proxy.Initiate(ctx, "job-1", req); err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	var statusErr *netpolprotocol.StatusError
+	if _, err := proxy.Initiate(ctx, "", req); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 while session job-1 is running, got %v", err)
+	}
+	waitConnectionsSent(t, proxy, "job-1")
+	if err := proxy.Stop(ctx, "job-1"); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, "job-1")
+
+	if _, err := proxy.Initiate(ctx, "job-1", req); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for the taken session ID job-1, got %v", err)
+	}
+	session, err := proxy.Initiate(ctx, "", req)
+	if err != nil {
+		t.Fatalf("expected a new session once job-1 is collected, got %v", err)
+	}
+	waitConnectionsSent(t, proxy, session)
+	if err := proxy.Stop(ctx, session); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, session)
+	if sessions := registry.list(); len(sessions) != 2 {
+		t.Errorf("expected 2 sessions, got %+v", sessions)
+	}
+}
+
+// Only the last maxSessions sessions are kept, in memory and in the state
+// file, and numeric IDs of dropped sessions aren't given again
+func TestSessionRetention(t *testing.T) {
+	maxSessions = 1
+	t.Cleanup(func() { maxSessions = defaultMaxSessions })
+	pods := map[string]*testPod{"pod-a": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	req := netpolprotocol.InitiateRequest{Connections: testConnections(pods)}
+
+	for i := 1; i <= 3; i++ {
+		session, err := proxy.Initiate(ctx, "", req)
+		if err != nil {
+			t.Fatalf("initiate: %v", err)
+		}
+		if session != strconv.Itoa(i) {
+			t.Errorf("expected session %d, got %q", i, session)
+		}
+		waitConnectionsSent(t, proxy, session)
+		if err := proxy.Stop(ctx, session); err != nil {
+			t.Fatalf("stop: %v", err)
+		}
+		waitResultsCollected(t, proxy, session)
+	}
+	if sessions := registry.list(); len(sessions) != 1 || sessions[0].ID != "3" || !sessions[0].Current {
+		t.Errorf("expected only the current session 3, got %+v", sessions)
+	}
+	var statusErr *netpolprotocol.StatusError
+	if _, err := proxy.Results(ctx, "2"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for the dropped session 2, got %v", err)
+	}
+	if state := snapshotState(); len(state.Sessions) != 1 || state.Sessions[0].ID != "3" {
+		t.Errorf("expected only session 3 in the state, got %+v", state.Sessions)
+	}
+
+	// a restored current session is kept even when it isn't the newest
+	old, current := newSession("old", defaultWorkload, nil), newSession("current", defaultWorkload, nil)
+	old.phase, current.phase = phaseCollected, phaseCollected
+	restoreState(&persistedState{CurrentSession: "current", Sessions: []persistedSession{current.snapshot(), old.snapshot()}})
+	if sessions := registry.list(); len(sessions) != 1 || sessions[0].ID != "current" || !sessions[0].Current {
+		t.Errorf("expected only the current restored session, got %+v", sessions)
+	}
+}
+
+// Response writer whose writes wait until unblock is closed, like a client
+// which stopped reading
+type stalledWriter struct {
+	httptest.ResponseRecorder
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	close(w.writing)
+	<-w.unblock
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestStatusStalledClient(t *testing.T) {
+	newTestProxy(t, nil)
+	conns := map[string][]connection{"pod-a": {{Addresses: []string{"10.0.0.1"}, Ports: []int32{8080}, Netpol: "np1"}}}
+	s, err := registry.start("", defaultWorkload, &initiateRequest{Connections: conns})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	s.updatePodStatus("pod-a", func(ps *podStatus) { ps.DeliveryAttempts = 1 })
+
+	w := &stalledWriter{ResponseRecorder: *httptest.NewRecorder(), writing: make(chan struct{}), unblock: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleStatus(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	}()
+	<-w.writing
+
+	// workers update statuses while the client doesn't read
+	updated := make(chan struct{})
+	go func() {
+		s.updatePodStatus("pod-a", func(ps *podStatus) { ps.Delivery = statusDelivered })
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pod status update blocked by a stalled /status client")
+	}
+	close(w.unblock)
+	<-done
+
+	var statuses map[string]podStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if ps := statuses["pod-a"]; ps.DeliveryAttempts != 1 || ps.Delivery != statusPending {
+		t.Errorf("expected the status as of the request, got %+v", ps)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// time to pull results or send connections on shutdown, below the default
+	// termination grace period of 30 seconds of pods
+	defaultShutdownTimeout = 25 * time.Second
+	shutdownPollInterval   = 100 * time.Millisecond
+)
+
+var (
+	shutdownTimeout = defaultShutdownTimeout
+	// set on SIGTERM or SIGINT, new sessions are rejected from then on
+	shuttingDown atomic.Bool
+)
+
+// Shutdown timeout when none is configured: in push mode, collection first
+// waits up to wait for pods to push their results, then pulls the others
+func defaultShutdownTimeoutFor(mode string, wait time.Duration) time.Duration {
+	if mode == resultsModePush {
+		return wait + defaultShutdownTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// Reply of /healthz and /readyz
+type healthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Whether the session is sending connections or collecting results
+func (s *session) busy() bool {
+	phase := s.getPhase()
+	return phase == phaseDistributing || phase == phaseCollecting
+}
+
+// Whether the proxy accepts a new session on /initiate, and why not
+func acceptingInitiate() (bool, string) {
+	if shuttingDown.Load() {
+		return false, "shutting down"
+	}
+	if current := registry.getCurrent(); current != nil && !current.resultsCollected() {
+		return false, fmt.Sprintf("session %s is running", current.ID)
+	}
+	return true, ""
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, reason string) {
+	resp := healthResponse{Status: "ok", Reason: reason}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		resp.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Liveness: the proxy serves requests, even while shutting down
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, true, "")
+}
+
+// Readiness: the proxy serves sessions until it shuts down. A running session
+// doesn't make it unready, kube-burner and client pods must still reach it
+// through its service, /version tells whether it accepts /initiate.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeHealth(w, false, "shutting down")
+		return
+	}
+	writeHealth(w, true, "")
+}
+
+// Wait until the current session is done sending connections or collecting
+// results, or until ctx is done. Returns whether it is done.
+func waitForCurrentSession(ctx context.Context) bool {
+	current := registry.getCurrent()
+	if current == nil {
+		return true
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for current.busy() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Stop accepting new sessions, give the current session up to
+// shutdownTimeout to finish the phase in progress, then checkpoint it to the
+// state file, from which the next proxy pod resumes it, and stop the server.
+func shutdown(server *http.Server) {
+	shuttingDown.Store(true)
+	slog.Info("shutting down", "timeout", shutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if current := registry.getCurrent(); current != nil && !waitForCurrentSession(ctx) {
+		if store != nil {
+			current.logger().Warn("shutdown timeout exceeded, the next proxy pod resumes the session from the state file", "phase", current.getPhase())
+		} else {
+			current.logger().Error("shutdown timeout exceeded without state file, the session is lost", "phase", current.getPhase())
+		}
+	}
+	flushState()
+	// kube-burner may still be checking the status, leave it a moment to be answered
+	serverCtx, serverCancel := context.WithTimeout(context.Background(), time.Second)
+	defer serverCancel()
+	if err := server.Shutdown(serverCtx); err != nil {
+		slog.Warn("failed to close connections", "error", err)
+	}
+	slog.Info("shut down")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Status code of /readyz
+func readyz(t *testing.T, proxy *netpolprotocol.ProxyClient) int {
+	t.Helper()
+	resp, err := http.Get(proxy.BaseURL + "/readyz")
+	if err != nil {
+		t.Fatalf("readyz: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func getVersion(t *testing.T, proxy *netpolprotocol.ProxyClient) versionResponse {
+	t.Helper()
+	resp, err := http.Get(proxy.BaseURL + "/version")
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	defer resp.Body.Close()
+	var version versionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		t.Fatalf("decode version: %v", err)
+	}
+	return version
+}
+
+// A running session keeps the proxy ready, so its service still routes
+// /checkStopStatus and /report to it, only /version tells it is busy
+func TestReadyWhileSessionRuns(t *testing.T) {
+	pods := map[string]*testPod{"pod-a": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	ctx := context.Background()
+	if version := getVersion(t, proxy); !version.AcceptingInitiate {
+		t.Errorf("expected /initiate accepted without session, got %+v", version)
+	}
+	if _, err := proxy.Initiate(ctx, "", netpolprotocol.InitiateRequest{Connections: testConnections(pods)}); err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	waitConnectionsSent(t, proxy, "")
+
+	if status := readyz(t, proxy); status != http.StatusOK {
+		t.Errorf("expected ready while session 1 runs, got %d", status)
+	}
+	if version := getVersion(t, proxy); version.AcceptingInitiate || version.Reason != "session 1 is running" {
+		t.Errorf("expected /initiate not accepted while session 1 runs, got %+v", version)
+	}
+
+	if err := proxy.Stop(ctx, ""); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, "")
+	if version := getVersion(t, proxy); !version.AcceptingInitiate {
+		t.Errorf("expected /initiate accepted once session 1 is collected, got %+v", version)
+	}
+
+	shuttingDown.Store(true)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	if status := readyz(t, proxy); status != http.StatusServiceUnavailable {
+		t.Errorf("expected unready while shutting down, got %d", status)
+	}
+	if version := getVersion(t, proxy); version.AcceptingInitiate || version.Reason != "shutting down" {
+		t.Errorf("expected /initiate not accepted while shutting down, got %+v", version)
+	}
+}
+
+// Collection on shutdown waits for pushed results before pulling the others,
+// the default timeout leaves time for both
+func TestDefaultShutdownTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		wait time.Duration
+		want time.Duration
+	}{
+		{resultsModePull, defaultReportWait, defaultShutdownTimeout},
+		{resultsModePush, defaultReportWait, defaultReportWait + defaultShutdownTimeout},
+		{resultsModePush, 0, defaultShutdownTimeout},
+	} {
+		timeout := defaultShutdownTimeoutFor(tc.mode, tc.wait)
+		if timeout != tc.want {
+			t.Errorf("%s mode with report wait %v: expected %v, got %v", tc.mode, tc.wait, tc.want, timeout)
+		}
+		if tc.mode == resultsModePush && timeout <= tc.wait {
+			t.Errorf("%s mode: expected the timeout %v to cover the report wait %v", tc.mode, timeout, tc.wait)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Simulation settings, simulatePods is 0 when the simulation is disabled
+var (
+	simulatePods           int
+	sim                    *simulation
+	simulateReadyLatency   = distribution{kind: "uniform", a: time.Second, b: 5 * time.Second}
+	simulateRequestLatency = distribution{kind: "fixed"}
+	simulateClockSkew      = distribution{kind: "fixed"}
+	simulateFailureRate    float64
+	simulateUnreachable    float64
+	// seed of the random draws of the simulation, 0 seeds from the current time
+	simulateSeed int64
+	simRand      = newLockedRand(time.Now().UnixNano())
+)
+
+// Random source shared by the handlers of all fake client pods
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) normFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.NormFloat64()
+}
+
+func (l *lockedRand) expFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.ExpFloat64()
+}
+
+// Random durations, written as:
+//   - fixed:<d>
+//   - uniform:<min>,<max>
+//   - normal:<mean>,<stddev>
+//   - exponential:<mean>
+type distribution struct {
+	kind string
+	a, b time.Duration
+}
+
+func parseDistribution(str string) (distribution, error) {
+	kind, params, _ := strings.Cut(str, ":")
+	var durations []time.Duration
+	for _, p := range strings.Split(params, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(p))
+		if err != nil {
+			return distribution{}, fmt.Errorf("invalid distribution %q: %v", str, err)
+		}
+		durations = append(durations, d)
+	}
+	want := map[string]int{"fixed": 1, "uniform": 2, "normal": 2, "exponential": 1}
+	n, ok := want[kind]
+	if !ok {
+		return distribution{}, fmt.Errorf("invalid distribution %q: unknown kind %q, use fixed, uniform, normal or exponential", str, kind)
+	}
+	if len(durations) != n {
+		return distribution{}, fmt.Errorf("invalid distribution %q: %s takes %d durations", str, kind, n)
+	}
+	d := distribution{kind: kind, a: durations[0]}
+	if n == 2 {
+		d.b = durations[1]
+	}
+	return d, nil
+}
+
+func (d distribution) String() string {
+	switch d.kind {
+	case "uniform", "normal":
+		return fmt.Sprintf("%s:%v,%v", d.kind, d.a, d.b)
+	}
+	return fmt.Sprintf("%s:%v", d.kind, d.a)
+}
+
+// Draw a duration, never negative
+func (d distribution) sample() time.Duration {
+	if v := d.sampleSigned(); v > 0 {
+		return v
+	}
+	return 0
+}
+
+// Draw a duration which may be negative, e.g. a clock offset
+func (d distribution) sampleSigned() time.Duration {
+	var v float64
+	switch d.kind {
+	case "uniform":
+		v = float64(d.a) + simRand.float64()*float64(d.b-d.a)
+	case "normal":
+		v = float64(d.a) + simRand.normFloat64()*float64(d.b)
+	case "exponential":
+		v = simRand.expFloat64() * float64(d.a)
+	default:
+		v = float64(d.a)
+	}
+	return time.Duration(v)
+}
+
+// Connection test of a fake client pod, reachable from readyAt on unless it never is
+type simTest struct {
+	connTest
+	readyAt   time.Time
+	reachable bool
+}
+
+// In-process stand-in for a netpolvalidator client pod, with its clock skew
+// ahead of the clock of the proxy pod
+type fakePod struct {
+	addr string
+	skew time.Duration
+	mu   sync.Mutex
+	// workload type of the last connections received, results are reported in its result type
+	workload workloadType
+	tests    []simTest
+}
+
+// Current time by the clock of the fake client pod
+func (p *fakePod) now() time.Time {
+	return time.Now().Add(p.skew).UTC()
+}
+
+// Wait for the simulated request latency and fail at the simulated failure
+// rate. Returns false when the request failed.
+func simulateRequest(w http.ResponseWriter) bool {
+	time.Sleep(simulateRequestLatency.sample())
+	if simRand.float64() < simulateFailureRate {
+		http.Error(w, "simulated failure", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// Accept connections of workload like a client pod and draw when each of
+// them becomes reachable
+func (p *fakePod) handleDelivery(workload workloadType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.handleConnections(w, r, workload)
+	}
+}
+
+func (p *fakePod) handleConnections(w http.ResponseWriter, r *http.Request, workload workloadType) {
+	if !simulateRequest(w) {
+		return
+	}
+	var conns []connection
+	if err := json.NewDecoder(r.Body).Decode(&conns); err != nil {
+		http.Error(w, "Unable to parse request body", http.StatusBadRequest)
+		return
+	}
+	now := p.now()
+	var tests []simTest
+	for idx, conn := range conns {
+		for _, address := range conn.Addresses {
+			for _, port := range conn.Ports {
+				test := simTest{
+					connTest:  connTest{Address: address, Port: int(port), IngressIdx: idx, NpName: conn.Netpol},
+					readyAt:   now.Add(simulateReadyLatency.sample()),
+					reachable: simRand.float64() >= simulateUnreachable,
+				}
+				test.Timestamp = test.readyAt
+				tests = append(tests, test)
+			}
+		}
+	}
+	p.mu.Lock()
+	p.workload = workload
+	p.tests = tests
+	p.mu.Unlock()
+	fmt.Fprintln(w, "Check Request received, processing...")
+}
+
+// Return the connections which became reachable so far, like a client pod
+func (p *fakePod) handleResults(w http.ResponseWriter, r *http.Request) {
+	if !simulateRequest(w) {
+		return
+	}
+	now := p.now()
+	results := []interface{}{}
+	p.mu.Lock()
+	for _, test := range p.tests {
+		if test.reachable && !test.readyAt.After(now) {
+			results = append(results, p.workload.encodeResult("", test.connTest))
+		}
+	}
+	p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	gw := netpolprotocol.NewResponseWriter(w, r)
+	defer gw.Close()
+	if err := json.NewEncoder(gw).Encode(results); err != nil {
+		http.Error(gw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Return the time by the clock of the fake client pod, like a client pod
+func (p *fakePod) handleTime(w http.ResponseWriter, r *http.Request) {
+	if !simulateRequest(w) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(netpolprotocol.TimeResponse{Time: p.now()}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Fake client pods, each pod key of a session is assigned the next free one
+type simulation struct {
+	pods []*fakePod
+
+	mu       sync.Mutex
+	assigned map[string]*fakePod
+}
+
+// Start n fake client pods listening on loopback ports
+func startSimulation(n int) (*simulation, error) {
+	seed := simulateSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	simRand = newLockedRand(seed)
+	sim := &simulation{assigned: make(map[string]*fakePod)}
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("failed to start fake client pod %d: %v", i, err)
+		}
+		pod := &fakePod{addr: listener.Addr().String(), skew: simulateClockSkew.sampleSigned()}
+		mux := http.NewServeMux()
+		for _, w := range workloadTypes {
+			mux.HandleFunc(w.deliveryPath(), pod.handleDelivery(w))
+		}
+		mux.HandleFunc("/results", pod.handleResults)
+		mux.HandleFunc("/time", pod.handleTime)
+		go http.Serve(listener, mux)
+		sim.pods = append(sim.pods, pod)
+	}
+	slog.Info("simulating client pods", "pods", n, "readyLatency", simulateReadyLatency.String(), "requestLatency", simulateRequestLatency.String(),
+		"clockSkew", simulateClockSkew.String(), "failureRate", simulateFailureRate, "unreachableRate", simulateUnreachable, "seed", seed)
+	return sim, nil
+}
+
+// Free the fake client pods for the pods of a new session
+func (sim *simulation) reset() {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.assigned = make(map[string]*fakePod)
+}
+
+// Map pod to its fake client pod, assigning the next free one to new pods
+func (sim *simulation) Resolve(ctx context.Context, pod string) (string, error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	fake, ok := sim.assigned[pod]
+	if !ok {
+		if len(sim.assigned) == len(sim.pods) {
+			return "", fmt.Errorf("all %d simulated client pods are assigned", len(sim.pods))
+		}
+		fake = sim.pods[len(sim.assigned)]
+		sim.assigned[pod] = fake
+	}
+	return fake.addr, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Use the simulation settings for the duration of the test
+func useSimulation(t *testing.T, ready, skew string, failureRate, unreachable float64) {
+	t.Helper()
+	var err error
+	if simulateReadyLatency, err = parseDistribution(ready); err != nil {
+		t.Fatalf("ready latency: %v", err)
+	}
+	if simulateClockSkew, err = parseDistribution(skew); err != nil {
+		t.Fatalf("clock skew: %v", err)
+	}
+	simulateFailureRate, simulateUnreachable, simulateSeed = failureRate, unreachable, 42
+	t.Cleanup(func() {
+		simulateReadyLatency = distribution{kind: "uniform", a: time.Second, b: 5 * time.Second}
+		simulateClockSkew = distribution{kind: "fixed"}
+		simulateFailureRate, simulateUnreachable, simulateSeed = 0, 0, 0
+	})
+}
+
+func TestDistributionSample(t *testing.T) {
+	simRand = newLockedRand(42)
+	for _, tc := range []struct {
+		spec     string
+		mean     time.Duration
+		min, max time.Duration
+	}{
+		{"fixed:250ms", 250 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond},
+		{"uniform:1s,3s", 2 * time.Second, time.Second, 3 * time.Second},
+		{"normal:2s,100ms", 2 * time.Second, 0, time.Hour},
+		{"exponential:500ms", 500 * time.Millisecond, 0, time.Hour},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			d, err := parseDistribution(tc.spec)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if d.String() != tc.spec {
+				t.Errorf("expected %s written back, got %s", tc.spec, d)
+			}
+			const n = 10000
+			var sum time.Duration
+			for i := 0; i < n; i++ {
+				v := d.sample()
+				if v < tc.min || v > tc.max {
+					t.Fatalf("expected samples within [%v, %v], got %v", tc.min, tc.max, v)
+				}
+				sum += v
+			}
+			if mean := sum / n; math.Abs(float64(mean-tc.mean)) > 0.05*float64(tc.mean) {
+				t.Errorf("expected a mean of %v, got %v", tc.mean, mean)
+			}
+		})
+	}
+	for _, spec := range []string{"uniform:1s", "poisson:1s", "fixed:fast"} {
+		if _, err := parseDistribution(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+	// negative draws only make sense as clock offsets
+	if d := (distribution{kind: "fixed", a: -time.Second}); d.sample() != 0 || d.sampleSigned() != -time.Second {
+		t.Errorf("expected a negative draw to count as 0 but as a clock offset, got %v and %v", d.sample(), d.sampleSigned())
+	}
+}
+
+// A session against fake client pods which fail some requests, never reach
+// some connections and whose clocks are skewed: retries deliver and collect
+// everything, unreachable connections are missing and latencies follow the
+// ready latency once timestamps are corrected
+func TestSimulatedSession(t *testing.T) {
+	const (
+		pods  = 20
+		ports = 10
+	)
+	useSimulation(t, "uniform:100ms,300ms", "uniform:-2s,2s", 0.1, 0.25)
+	simulation, err := startSimulation(pods)
+	if err != nil {
+		t.Fatalf("start simulation: %v", err)
+	}
+	sim, podClient.Resolver = simulation, simulation
+	t.Cleanup(func() { sim, podClient.Resolver = nil, testPods })
+	proxy := newTestProxy(t, nil)
+	ctx := context.Background()
+
+	conns := make(map[string][]connection)
+	for i := 0; i < pods; i++ {
+		var podPorts []int32
+		for port := 0; port < ports; port++ {
+			podPorts = append(podPorts, int32(8000+port))
+		}
+		conns[fmt.Sprintf("pod-%d", i)] = []connection{{Addresses: []string{fmt.Sprintf("10.0.0.%d", i+1)}, Ports: podPorts, Netpol: "np1"}}
+	}
+	session, err := proxy.Initiate(ctx, "", netpolprotocol.InitiateRequest{Connections: conns})
+	if err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	if status := waitConnectionsSent(t, proxy, session); len(status.FailedPods) > 0 {
+		t.Fatalf("expected retries to deliver to all pods, got %+v", status)
+	}
+	// every connection is ready once the slowest delivery is past its latest ready latency
+	time.Sleep(500 * time.Millisecond)
+	if err := proxy.Stop(ctx, session); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if status := waitResultsCollected(t, proxy, session); status.Partial || len(status.FailedPods) > 0 {
+		t.Fatalf("expected retries to collect from all pods, got %+v", status)
+	}
+
+	s, _ := registry.get(session)
+	attempts, skewed := 0, 0
+	for pod := range conns {
+		ps := s.getPodStatus(pod)
+		attempts += ps.DeliveryAttempts + ps.CollectionAttempts
+		if ps.Clock != nil && math.Abs(ps.Clock.OffsetMs) > 100 {
+			skewed++
+		}
+	}
+	if attempts <= 2*pods {
+		t.Errorf("expected requests failing at a 10%% rate to be retried, got %d attempts for %d pods", attempts, pods)
+	}
+	if skewed == 0 {
+		t.Error("expected clock offsets of fake client pods to be measured")
+	}
+
+	summary := s.summarize(s.StartTime, referenceInitiate)
+	expected := pods * ports
+	if summary.Overall.Expected != expected {
+		t.Fatalf("expected %d connection tests, got %d", expected, summary.Overall.Expected)
+	}
+	if rate := float64(summary.Overall.NeverReachable) / float64(expected); rate < 0.15 || rate > 0.35 {
+		t.Errorf("expected about 25%% of connections never reachable, got %d of %d", summary.Overall.NeverReachable, expected)
+	}
+	if summary.Overall.Count != expected-summary.Overall.NeverReachable {
+		t.Errorf("expected a latency per reached connection, got %d", summary.Overall.Count)
+	}
+	// connections are ready 100ms to 300ms after delivery, by the clock of the proxy pod
+	if summary.Overall.Min < 90 || summary.Overall.P50 > 1000 {
+		t.Errorf("expected latencies from the ready latency once corrected, got %+v", summary.Overall.latencyStats)
+	}
+	missing := s.missing(resultsFilter{})
+	if missing.Missing != summary.Overall.NeverReachable {
+		t.Errorf("expected the %d unreachable connections missing, got %d", summary.Overall.NeverReachable, missing.Missing)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	statusPending   = "pending"
+	statusRetrying  = "retrying"
+	statusFailed    = "failed"
+	statusDelivered = "delivered"
+	statusCollected = "collected"
+
+	defaultMaxRetries = 5
+	initialBackoff    = time.Second
+	maxBackoff        = 30 * time.Second
+)
+
+// Progress of a single client pod through delivery of its connections and
+// collection of its results
+type podStatus struct {
+	Delivery           string `json:"delivery"`
+	DeliveryAttempts   int    `json:"deliveryAttempts"`
+	DeliveryError      string `json:"deliveryError,omitempty"`
+	Collection         string `json:"collection"`
+	CollectionAttempts int    `json:"collectionAttempts"`
+	CollectionError    string `json:"collectionError,omitempty"`
+	// estimated while sending connections, nil when unknown
+	Clock *clockOffset `json:"clock,omitempty"`
+}
+
+var maxRetries = defaultMaxRetries
+
+func (s *session) getPodStatus(pod string) podStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ps, ok := s.podStatuses[pod]; ok {
+		return *ps
+	}
+	return podStatus{Delivery: statusPending, Collection: statusPending}
+}
+
+// Apply update to the status of pod, creating it if needed
+func (s *session) updatePodStatus(pod string, update func(ps *podStatus)) {
+	s.mu.Lock()
+	ps, ok := s.podStatuses[pod]
+	if !ok {
+		ps = &podStatus{Delivery: statusPending, Collection: statusPending}
+		s.podStatuses[pod] = ps
+	}
+	update(ps)
+	s.mu.Unlock()
+	saveState()
+}
+
+// Return pods whose delivery or collection, depending on collection, failed
+func (s *session) failedPods(collection bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var failed []string
+	for pod := range s.connections {
+		ps, ok := s.podStatuses[pod]
+		if !ok {
+			continue
+		}
+		if (!collection && ps.Delivery == statusFailed) || (collection && ps.Collection == statusFailed) {
+			failed = append(failed, pod)
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// Run fn until it succeeds, up to maxRetries retries with exponential backoff,
+// or until ctx is done. setStatus is called with statusRetrying before every
+// retry, which is logged to the logger of the pod.
+func retryPod(ctx context.Context, logger *slog.Logger, action string, setStatus func(status string, attempts int, err error), fn func() error) error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s aborted after %d attempts: %v", action, attempt, ctx.Err())
+		}
+		if attempt > maxRetries {
+			return fmt.Errorf("%s failed after %d attempts: %v", action, attempt, err)
+		}
+		logger.Warn("failed to "+action+", retrying", "attempt", attempt, "backoff", backoff.String(), "error", err)
+		setStatus(statusRetrying, attempt, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%s aborted after %d attempts: %v", action, attempt, ctx.Err())
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Return delivery and collection status of every client pod of a session
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	// a slow client must not hold up workers updating statuses
+	s.mu.Lock()
+	statuses := make(map[string]podStatus, len(s.podStatuses))
+	for pod, ps := range s.podStatuses {
+		statuses[pod] = *ps
+	}
+	s.mu.Unlock()
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const storeFlushInterval = time.Second
+
+// State of the proxy persisted to disk so that a restarted proxy pod can resume the job
+type persistedState struct {
+	CurrentSession string             `json:"currentSession"`
+	Sessions       []persistedSession `json:"sessions"`
+}
+
+type persistedSession struct {
+	ID             string                  `json:"id"`
+	StartTime      time.Time               `json:"startTime"`
+	Workload       string                  `json:"workload,omitempty"`
+	Connections    map[string][]connection `json:"connections"`
+	NetpolCreated  map[string]time.Time    `json:"netpolCreated,omitempty"`
+	Phase          phase                   `json:"phase"`
+	PodStatuses    map[string]*podStatus   `json:"podStatuses"`
+	StopRequested  bool                    `json:"stopRequested"`
+	ClusterResults map[string][]connTest   `json:"clusterResults"`
+}
+
+// Writes the proxy state to a JSON file. Writes are batched by marking the
+// store dirty and flushing it periodically, since the state is saved after
+// every single pod.
+type stateStore struct {
+	path  string
+	mu    sync.Mutex
+	dirty bool
+}
+
+// store is nil when persistence is disabled
+var store *stateStore
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{path: path}
+}
+
+// Mark the state as changed, it is written on the next flush
+func saveState() {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	store.dirty = true
+	store.mu.Unlock()
+}
+
+// Write the state now, used when a phase of the job completes
+func flushState() {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.dirty = false
+	if err := store.write(snapshotState()); err != nil {
+		slog.Error("failed to persist state", "path", store.path, "error", err)
+	}
+}
+
+// Flush the state periodically when it changed
+func (s *stateStore) run() {
+	ticker := time.NewTicker(storeFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		if s.dirty {
+			s.dirty = false
+			if err := s.write(snapshotState()); err != nil {
+				slog.Error("failed to persist state", "path", s.path, "error", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Write to a temporary file and rename it so a crash never leaves a truncated state file
+func (s *stateStore) write(state persistedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Read the state written by a previous proxy pod, if any
+func (s *stateStore) load() (*persistedState, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Copy the state of all sessions under their locks
+func snapshotState() persistedState {
+	var state persistedState
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.current != nil {
+		state.CurrentSession = registry.current.ID
+	}
+	for _, id := range registry.ids {
+		state.Sessions = append(state.Sessions, registry.sessions[id].snapshot())
+	}
+	return state
+}
+
+func (s *session) snapshot() persistedSession {
+	ps := persistedSession{
+		ID:             s.ID,
+		StartTime:      s.StartTime,
+		Workload:       s.Workload,
+		Connections:    s.connections,
+		NetpolCreated:  s.netpolCreated,
+		PodStatuses:    make(map[string]*podStatus),
+		ClusterResults: make(map[string][]connTest),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps.Phase = s.phase
+	ps.StopRequested = s.stopRequested
+	for pod, status := range s.podStatuses {
+		statusCopy := *status
+		ps.PodStatuses[pod] = &statusCopy
+	}
+	// mergeResults and correctTimestamps update results in place, the state
+	// is written once s.mu is released
+	for pod, results := range s.clusterResults {
+		copied := make([]connTest, len(results))
+		copy(copied, results)
+		ps.ClusterResults[pod] = copied
+	}
+	return ps
+}
+
+// Restore the sessions of a previous proxy pod and resume the current one where it stopped
+func restoreState(state *persistedState) {
+	registry.mu.Lock()
+	for _, ps := range state.Sessions {
+		// state files written before workload types are netpol sessions
+		workload := ps.Workload
+		if workload == "" {
+			workload = defaultWorkload
+		}
+		s := newSession(ps.ID, workload, ps.Connections)
+		s.StartTime = ps.StartTime
+		s.netpolCreated = ps.NetpolCreated
+		if ps.PodStatuses != nil {
+			s.podStatuses = ps.PodStatuses
+		}
+		if ps.ClusterResults != nil {
+			s.clusterResults = ps.ClusterResults
+		}
+		s.phase = ps.Phase
+		// delivery was interrupted, resume it, sendConnections skips pods
+		// which already got their connections
+		if s.phase == phaseDistributing {
+			s.phase = phaseIdle
+		}
+		s.stopRequested = ps.StopRequested
+		registry.add(s)
+	}
+	registry.current = registry.sessions[state.CurrentSession]
+	registry.evict()
+	current := registry.current
+	registry.mu.Unlock()
+	slog.Info("restored sessions", "sessions", len(state.Sessions))
+	if current == nil {
+		return
+	}
+	current.logger().Info("restored current session", "pods", len(current.connections), "podsWithResults", len(current.clusterResults),
+		"phase", current.phase, "stopRequested", current.stopRequested)
+	setSessionMetrics(current.connections)
+	current.resume()
+}
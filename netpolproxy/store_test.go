@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestoreDistributingSession(t *testing.T) {
+	pods := map[string]*testPod{"pod-a": newTestPod(t), "pod-b": newTestPod(t)}
+	proxy := newTestProxy(t, pods)
+	conns := testConnections(pods)
+
+	// a previous proxy pod delivered connections to pod-a only
+	previous := newSession("1", defaultWorkload, conns)
+	previous.phase = phaseDistributing
+	previous.podStatuses["pod-a"] = &podStatus{Delivery: statusDelivered, DeliveryAttempts: 1, Collection: statusPending}
+	previousStore := newStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err := previousStore.write(persistedState{CurrentSession: "1", Sessions: []persistedSession{previous.snapshot()}}); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	state, err := previousStore.load()
+	if err != nil || state == nil {
+		t.Fatalf("load state: %v", err)
+	}
+	restoreState(state)
+
+	waitConnectionsSent(t, proxy, "1")
+	if checks, _ := pods["pod-a"].requests(); checks != 0 {
+		t.Errorf("expected no delivery to pod-a, already delivered, got %d", checks)
+	}
+	if checks, _ := pods["pod-b"].requests(); checks != 1 {
+		t.Errorf("expected delivery to pod-b to resume, got %d", checks)
+	}
+	if err := proxy.Stop(context.Background(), "1"); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	waitResultsCollected(t, proxy, "1")
+
+	// the state file follows the session
+	waitFor(t, "collected session in the state file", func() (bool, error) {
+		state, err := store.load()
+		if err != nil || state == nil {
+			return false, err
+		}
+		return len(state.Sessions) == 1 && state.Sessions[0].Phase == phaseCollected, nil
+	})
+}
+
+func TestSnapshotDuringMerge(t *testing.T) {
+	newTestProxy(t, nil)
+	conns := map[string][]connection{"pod-a": {{Addresses: []string{"10.0.0.1"}, Ports: []int32{8080}, Netpol: "np1"}}}
+	s, err := registry.start("", defaultWorkload, &initiateRequest{Connections: conns})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	s.updatePodStatus("pod-a", func(ps *podStatus) {
+		ps.Clock = &clockOffset{OffsetMs: 5}
+	})
+	reached := time.Now()
+	s.mergeResults("pod-a", []connTest{{Address: "10.0.0.1", Port: 8080, NpName: "np1", Timestamp: reached}})
+
+	// earlier results replace the stored ones in place while the state is written
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			s.mergeResults("pod-a", []connTest{{Address: "10.0.0.1", Port: 8080, NpName: "np1", Timestamp: reached.Add(-time.Duration(i) * time.Millisecond)}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		flushState()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Readiness latency distribution of a set of connection tests, in milliseconds
+type latencyStats struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"minMs"`
+	Avg   float64 `json:"avgMs"`
+	P50   float64 `json:"p50Ms"`
+	P95   float64 `json:"p95Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+// What latencies are measured from
+const (
+	// the creation time of the group, e.g. of the network policy sent on /initiate
+	referenceCreated = "created"
+	// the since query parameter of /summary
+	referenceSince = "since"
+	// the session start, when the creation time is unknown
+	referenceInitiate = "initiate"
+)
+
+// Latencies of a group of results, e.g. of a network policy, or of all of them
+type groupSummary struct {
+	latencyStats
+	Expected       int `json:"expected"`
+	NeverReachable int `json:"neverReachable"`
+	// time latencies of the group are measured from, unset overall
+	Reference       *time.Time `json:"reference,omitempty"`
+	ReferenceSource string     `json:"referenceSource,omitempty"`
+}
+
+// Aggregated results of a session returned by /summary. Reference is what
+// latencies of groups without a creation time are measured from.
+type resultsSummary struct {
+	Session         string       `json:"session"`
+	Reference       time.Time    `json:"reference"`
+	ReferenceSource string       `json:"referenceSource"`
+	Pods            int          `json:"pods"`
+	PodsWithResults int          `json:"podsWithResults"`
+	Overall         groupSummary `json:"overall"`
+	// encoded under the groups key of the workload type, e.g. policies
+	Groups    map[string]groupSummary `json:"-"`
+	groupsKey string
+}
+
+func (s resultsSummary) MarshalJSON() ([]byte, error) {
+	type fields resultsSummary
+	return marshalWithGroups(fields(s), s.groupsKey, s.Groups)
+}
+
+// Encode v, a struct, with groups added under key
+func marshalWithGroups(v interface{}, key string, groups interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	groupsData, err := json.Marshal(groups)
+	if err != nil {
+		return nil, err
+	}
+	// insert the groups before the closing brace of the object
+	out := append(data[:len(data)-1:len(data)-1], ',')
+	out = append(out, keyData...)
+	out = append(out, ':')
+	out = append(out, groupsData...)
+	return append(out, '}'), nil
+}
+
+// Identifies a connection test independently of its result
+type connKey struct {
+	Address string
+	Port    int
+	NpName  string
+}
+
+// Return the connection tests a pod is expected to report, one per address and port of every connection
+func expectedConnTests(conns []connection) []connKey {
+	var keys []connKey
+	for _, conn := range conns {
+		for _, address := range conn.Addresses {
+			for _, port := range conn.Ports {
+				keys = append(keys, connKey{Address: address, Port: int(port), NpName: conn.Netpol})
+			}
+		}
+	}
+	return keys
+}
+
+// Compute latency stats of latencies, sorting them in place
+func computeLatencyStats(latencies []float64) latencyStats {
+	stats := latencyStats{Count: len(latencies)}
+	if len(latencies) == 0 {
+		return stats
+	}
+	sort.Float64s(latencies)
+	var sum float64
+	for _, l := range latencies {
+		sum += l
+	}
+	stats.Min = latencies[0]
+	stats.Max = latencies[len(latencies)-1]
+	stats.Avg = sum / float64(len(latencies))
+	stats.P50 = percentile(latencies, 50)
+	stats.P95 = percentile(latencies, 95)
+	stats.P99 = percentile(latencies, 99)
+	return stats
+}
+
+// Nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Return the time latencies of group are measured from, and where it comes
+// from: the creation time of the group when the workload type knows it, e.g.
+// of the network policy when kube-burner sent it, unless source is since,
+// otherwise reference
+func (s *session) groupReference(group string, reference time.Time, source string) (time.Time, string) {
+	if source != referenceSince {
+		if created, ok := s.workloadType().latencyReference(s, group); ok {
+			return created, referenceCreated
+		}
+	}
+	return reference, source
+}
+
+// Aggregate the results of the session per group and overall. The readiness
+// latency of a connection is the time from the creation of its group, e.g.
+// of its network policy, or from reference, until the client pod first
+// reached it.
+func (s *session) summarize(reference time.Time, source string) resultsSummary {
+	summary := resultsSummary{
+		Session:         s.ID,
+		Reference:       reference,
+		ReferenceSource: source,
+		Pods:            len(s.connections),
+		Groups:          make(map[string]groupSummary),
+		groupsKey:       s.workloadType().grouping().key,
+	}
+	latencies := make(map[string][]float64)
+	var allLatencies []float64
+	expected := make(map[string]int)
+	reached := make(map[string]int)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for pod, conns := range s.connections {
+		results, ok := s.clusterResults[pod]
+		if ok && len(results) > 0 {
+			summary.PodsWithResults++
+		}
+		seen := make(map[connKey]bool)
+		for _, res := range results {
+			key := connKey{Address: res.Address, Port: res.Port, NpName: res.NpName}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			groupReference, _ := s.groupReference(res.NpName, reference, source)
+			latency := float64(correctedTimestamp(res).Sub(groupReference)) / float64(time.Millisecond)
+			latencies[res.NpName] = append(latencies[res.NpName], latency)
+			allLatencies = append(allLatencies, latency)
+		}
+		for _, key := range expectedConnTests(conns) {
+			expected[key.NpName]++
+			if seen[key] {
+				reached[key.NpName]++
+			}
+		}
+	}
+	for npName := range expected {
+		groupReference, groupSource := s.groupReference(npName, reference, source)
+		summary.Groups[npName] = groupSummary{
+			latencyStats:    computeLatencyStats(latencies[npName]),
+			Expected:        expected[npName],
+			NeverReachable:  expected[npName] - reached[npName],
+			Reference:       &groupReference,
+			ReferenceSource: groupSource,
+		}
+		summary.Overall.Expected += expected[npName]
+		summary.Overall.NeverReachable += expected[npName] - reached[npName]
+	}
+	summary.Overall.latencyStats = computeLatencyStats(allLatencies)
+	return summary
+}
+
+// Return aggregated results of a session. Latencies are measured from the
+// creation time of groups, e.g. of network policies sent on /initiate, from
+// the session start for groups without one, or from the RFC 3339 time in the
+// since query parameter for all of them.
+func handleSummary(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	reference, source := s.StartTime, referenceInitiate
+	if since := r.URL.Query().Get("since"); since != "" {
+		var err error
+		reference, err = time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid since %q, RFC 3339 time required", since))
+			return
+		}
+		source = referenceSince
+	}
+	if err := json.NewEncoder(w).Encode(s.summarize(reference, source)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
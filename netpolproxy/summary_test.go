@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeLatencyStats(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		latencies []float64
+		want      latencyStats
+	}{
+		{"empty", nil, latencyStats{}},
+		{"one sample", []float64{5}, latencyStats{Count: 1, Min: 5, Avg: 5, P50: 5, P95: 5, P99: 5, Max: 5}},
+		// nearest rank: p50 is the 2nd of 4 values, p95 and p99 the 4th
+		{"even", []float64{40, 10, 30, 20}, latencyStats{Count: 4, Min: 10, Avg: 25, P50: 20, P95: 40, P99: 40, Max: 40}},
+		{"odd", []float64{30, 10, 20}, latencyStats{Count: 3, Min: 10, Avg: 20, P50: 20, P95: 30, P99: 30, Max: 30}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if stats := computeLatencyStats(tc.latencies); stats != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, stats)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]float64, 100)
+	for i := range sorted {
+		sorted[i] = float64(i + 1)
+	}
+	for _, tc := range []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{1, 1},
+		{50, 50},
+		{50.5, 51},
+		{95, 95},
+		{99, 99},
+		{100, 100},
+	} {
+		if v := percentile(sorted, tc.p); v != tc.want {
+			t.Errorf("p%v of 1..100: expected %v, got %v", tc.p, tc.want, v)
+		}
+	}
+}
+
+// Session of a pod reaching np1 and np2 at 10s and 20s after start, np1
+// created 5s after start
+func newSummarySession() *session {
+	s := newSession("summary", defaultWorkload, map[string][]connection{
+		"pod-a": {
+			{Addresses: []string{"10.0.0.1"}, Ports: []int32{8080}, Netpol: "np1"},
+			{Addresses: []string{"10.0.0.2"}, Ports: []int32{8080}, Netpol: "np2"},
+		},
+	})
+	s.StartTime = time.Date(2024, 10, 1, 11, 0, 0, 0, time.UTC)
+	s.netpolCreated = map[string]time.Time{"np1": s.StartTime.Add(5 * time.Second)}
+	reached := s.StartTime.Add(20 * time.Second)
+	s.clusterResults["pod-a"] = []connTest{
+		{Address: "10.0.0.1", Port: 8080, NpName: "np1", Timestamp: s.StartTime.Add(time.Hour), CorrectedTimestamp: timePtr(s.StartTime.Add(10 * time.Second))},
+		{Address: "10.0.0.2", Port: 8080, IngressIdx: 1, NpName: "np2", Timestamp: reached},
+	}
+	return s
+}
+
+func timePtr(v time.Time) *time.Time {
+	return &v
+}
+
+// Check the latency, reference and source of group in summary
+func expectGroup(t *testing.T, summary resultsSummary, group string, latency float64, reference time.Time, source string) {
+	t.Helper()
+	g, ok := summary.Groups[group]
+	if !ok {
+		t.Fatalf("expected group %s in %+v", group, summary.Groups)
+	}
+	if g.Count != 1 || g.Min != latency || g.Expected != 1 || g.NeverReachable != 0 {
+		t.Errorf("%s: expected a latency of %vms, got %+v", group, latency, g.latencyStats)
+	}
+	if g.Reference == nil || !g.Reference.Equal(reference) || g.ReferenceSource != source {
+		t.Errorf("%s: expected latencies from %v (%s), got %v (%s)", group, reference, source, g.Reference, g.ReferenceSource)
+	}
+}
+
+// Groups with a creation time are measured from it, with the corrected
+// timestamp of results
+func TestSummaryReferenceCreated(t *testing.T) {
+	s := newSummarySession()
+	summary := s.summarize(s.StartTime, referenceInitiate)
+	expectGroup(t, summary, "np1", 5000, s.netpolCreated["np1"], referenceCreated)
+	if summary.Overall.Count != 2 || summary.Overall.Expected != 2 {
+		t.Errorf("expected 2 latencies overall, got %+v", summary.Overall)
+	}
+}
+
+// Groups without a creation time are measured from the session start
+func TestSummaryReferenceInitiate(t *testing.T) {
+	s := newSummarySession()
+	summary := s.summarize(s.StartTime, referenceInitiate)
+	expectGroup(t, summary, "np2", 20000, s.StartTime, referenceInitiate)
+	if summary.ReferenceSource != referenceInitiate || !summary.Reference.Equal(s.StartTime) {
+		t.Errorf("expected the session start as reference, got %v (%s)", summary.Reference, summary.ReferenceSource)
+	}
+}
+
+// since overrides the creation time of every group
+func TestSummaryReferenceSince(t *testing.T) {
+	s := newSummarySession()
+	since := s.StartTime.Add(2 * time.Second)
+	summary := s.summarize(since, referenceSince)
+	expectGroup(t, summary, "np1", 8000, since, referenceSince)
+	expectGroup(t, summary, "np2", 18000, since, referenceSince)
+	if summary.Overall.Min != 8000 || summary.Overall.Max != 18000 {
+		t.Errorf("expected overall latencies of 8000ms and 18000ms, got %+v", summary.Overall.latencyStats)
+	}
+}
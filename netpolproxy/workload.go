@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Type of workload orchestrated by the proxy. The orchestration core runs
+// every session through initiate, distribute, stop and collect: it paces and
+// retries requests to client pods, tracks their status, persists sessions and
+// merges, exports and summarizes results. A workload type defines the
+// /initiate payload kube-burner sends, the endpoint of client pods it is
+// delivered to, the results client pods report, what their latencies are
+// measured from and how they are grouped. The core holds the results of every
+// workload type as connection tests, grouped by their npname.
+type workloadType interface {
+	// decode an /initiate payload into the connections of every client pod
+	decode(body []byte) (*initiateRequest, error)
+	// problems found in a decoded payload, at most maxValidationErrors of them
+	validate(req *initiateRequest) []string
+	// endpoint of client pods the connections are delivered to
+	deliveryPath() string
+	// retrieve the results of a client pod from its /results endpoint, in
+	// batches of up to batchSize results passed to fn, which must not retain them
+	streamResults(ctx context.Context, pod string, batchSize int, fn func(batch []connTest) error) error
+	// results of a batch pushed to /report
+	reportedResults(report *resultsReport) []connTest
+	// res in the result type of the workload, as client pods report it and
+	// /results exports it, along with pod when set
+	encodeResult(pod string, res connTest) interface{}
+	// time latencies of a group of results are measured from, when known
+	latencyReference(s *session, group string) (time.Time, bool)
+	grouping() grouping
+}
+
+// How a workload type names the groups of its results and their index
+type grouping struct {
+	// key of the groups in /summary and /missing, e.g. policies
+	key string
+	// CSV column and filter query parameter of the group, e.g. netpol
+	column string
+	// CSV column of the index of the connection, e.g. ingressidx
+	index string
+}
+
+const defaultWorkload = netpolprotocol.WorkloadNetpol
+
+var workloadTypes = make(map[string]workloadType)
+
+// Make a workload type available to /initiate, called from init functions
+func registerWorkload(name string, w workloadType) {
+	if _, ok := workloadTypes[name]; ok {
+		panic(fmt.Sprintf("workload type %q registered twice", name))
+	}
+	workloadTypes[name] = w
+}
+
+func lookupWorkload(name string) (workloadType, error) {
+	if name == "" {
+		name = defaultWorkload
+	}
+	w, ok := workloadTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown workload type %q, use one of %v", name, workloadNames())
+	}
+	return w, nil
+}
+
+// Names of the registered workload types, sorted
+func workloadNames() []string {
+	names := make([]string, 0, len(workloadTypes))
+	for name := range workloadTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Workload type of the session, registered when the session was started or restored
+func (s *session) workloadType() workloadType {
+	return workloadTypes[s.Workload]
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestPodKey(t *testing.T) {
+	for _, tc := range []struct {
+		name, podIP, podName, want string
+	}{
+		{"pod IP", "10.128.2.52", "", "10.128.2.52"},
+		{"pod name", "10.128.2.52", "client-0", "client-0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("POD_IP", tc.podIP)
+			t.Setenv("POD_NAME", tc.podName)
+			processEnvVars()
+			if podKey != tc.want {
+				t.Errorf("expected pod key %q, got %q", tc.want, podKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/netpolprotocol"
+)
+
+// Start a client pod serving the endpoints of main, returning a PodClient
+// addressing it by its pod key 127.0.0.1
+func newTestPod(t *testing.T) *netpolprotocol.PodClient {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", handleConnections(netpolWorkload))
+	mux.HandleFunc("/reach", handleConnections(reachWorkload))
+	mux.HandleFunc("/results", resultsHandler)
+	mux.HandleFunc("/time", timeHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return &netpolprotocol.PodClient{
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+		Scheme:     "http",
+		Port:       port(t, server.URL),
+	}
+}
+
+func port(t *testing.T, rawURL string) int {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse %s: %v", rawURL, err)
+	}
+	_, p, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatalf("split %s: %v", u.Host, err)
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		t.Fatalf("port %s: %v", p, err)
+	}
+	return n
+}
+
+// Connections are received once per pod, so a single test drives the
+// exchange with the proxy pod from delivery to collection
+func TestPodClientContract(t *testing.T) {
+	log.SetOutput(io.Discard)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(target.Close)
+	targetPort := int32(port(t, target.URL))
+	go sendRequests()
+
+	client := newTestPod(t)
+	ctx := context.Background()
+	const pod = "127.0.0.1"
+	conns := []netpolprotocol.Connection{
+		{Addresses: []string{pod}, Ports: []int32{targetPort}, Netpol: "np1"},
+		{Addresses: []string{pod}, Ports: []int32{targetPort}, Netpol: "np2"},
+	}
+	sent := time.Now().UTC()
+	if err := client.SendConnections(ctx, pod, conns); err != nil {
+		t.Fatalf("send connections: %v", err)
+	}
+
+	var results []netpolprotocol.ConnTest
+	deadline := time.Now().Add(10 * time.Second)
+	for len(results) < len(conns) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for results, got %+v", results)
+		}
+		time.Sleep(50 * time.Millisecond)
+		results = nil
+		err := client.StreamResults(ctx, pod, 1, func(batch []netpolprotocol.ConnTest) error {
+			results = append(results, batch...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("stream results: %v", err)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, res := range results {
+		if res.Address != pod || res.Port != int(targetPort) {
+			t.Errorf("expected result for %s:%d, got %+v", pod, targetPort, res)
+		}
+		if res.IngressIdx < 0 || res.IngressIdx >= len(conns) || res.NpName != conns[res.IngressIdx].Netpol {
+			t.Errorf("expected ingressidx to index the network policy of the connection, got %+v", res)
+		}
+		if res.Timestamp.Before(sent) {
+			t.Errorf("expected a timestamp after the connections were sent, got %+v", res)
+		}
+		seen[res.IngressIdx] = true
+	}
+	if len(seen) != len(conns) {
+		t.Errorf("expected a result per connection, got %+v", results)
+	}
+
+	clock, err := client.Time(ctx, pod)
+	if err != nil {
+		t.Fatalf("time: %v", err)
+	}
+	if offset := time.Since(clock); offset < 0 || offset > 5*time.Second {
+		t.Errorf("expected the clock of the pod, got %v", clock)
+	}
+}
+
+// Results of the http workload are served and pushed as ReachResults
+func TestReachWorkloadResults(t *testing.T) {
+	reached := time.Now().UTC()
+	results := []netpolprotocol.ConnTest{{Address: "10.0.0.1", Port: 8080, IngressIdx: 1, NpName: "svc1", Timestamp: reached}}
+	data, err := json.Marshal(reachWorkload.encode(results))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var served []netpolprotocol.ReachResult
+	err = netpolprotocol.DecodeReachResults(bytes.NewReader(data), 10, func(batch []netpolprotocol.ReachResult) error {
+		served = append(served, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := netpolprotocol.ReachResult{Address: "10.0.0.1", Port: 8080, TargetIdx: 1, Group: "svc1", Timestamp: reached}
+	if len(served) != 1 || served[0] != want {
+		t.Errorf("expected %+v served, got %+v", want, served)
+	}
+
+	var report netpolprotocol.ResultsReport
+	reachWorkload.addToReport(&report, results)
+	if len(report.Results) != 0 || len(report.Reached) != 1 || report.Reached[0] != want {
+		t.Errorf("expected %+v pushed as reached, got %+v", want, report)
+	}
+	netpolWorkload.addToReport(&report, results)
+	if len(report.Results) != 1 || report.Results[0].NpName != "svc1" {
+		t.Errorf("expected netpol results pushed as results, got %+v", report)
+	}
+}
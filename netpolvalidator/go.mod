@@ -1,3 +1,7 @@
 module example.com/netpolvalidator
 
-go 1.21.9
+go 1.21.10
+
+require example.com/netpolprotocol v0.0.0
+
+replace example.com/netpolprotocol => ../netpolprotocol
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,27 +9,20 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"example.com/netpolprotocol"
 )
 
 // Used to gather connection information from kube-burner proxy pod
-type connection struct {
-	Addresses []string `json:"addresses"`
-	Ports     []int    `json:"ports"`
-	Netpol    string   `json:"netpol"`
-}
+type connection = netpolprotocol.Connection
 
 var connections []connection
 
 // Local copy of connection information and also stores the result i.e succesful connection timestamp
-type connTest struct {
-	Address    string    `json:"address"`
-	Port       int       `json:"port"`
-	IngressIdx int       `json:"connectionidx"`
-	NpName     string    `json:"npname"`
-	Timestamp  time.Time `json:"timestamp"`
-}
+type connTest = netpolprotocol.ConnTest
 
 var parallelConnections = 10
 
@@ -45,6 +39,44 @@ var (
 
 var allConnTests []connTest
 
+// Workload type of the proxy pod: how this pod tests the connections it
+// receives and reports their results. Results of every workload are held as
+// connection tests, grouped by their npname.
+type workload struct {
+	// wait for kube-burner to start the job before testing connections
+	waitForJob bool
+	// results in the result type of the workload, as served on /results
+	encode func(results []connTest) interface{}
+	// add a batch of results to a report pushed to the proxy pod
+	addToReport func(report *netpolprotocol.ResultsReport, batch []connTest)
+}
+
+var (
+	// network policy latency: connections received on /check wait for
+	// kube-burner to start the job
+	netpolWorkload = &workload{
+		waitForJob:  true,
+		encode:      func(results []connTest) interface{} { return results },
+		addToReport: func(report *netpolprotocol.ResultsReport, batch []connTest) { report.Results = batch },
+	}
+	// HTTP reachability: targets received on /reach are tested right away
+	reachWorkload = &workload{
+		encode:      func(results []connTest) interface{} { return reachResults(results) },
+		addToReport: func(report *netpolprotocol.ResultsReport, batch []connTest) { report.Reached = reachResults(batch) },
+	}
+	// workload of the connections received, guarded by resultsLock
+	activeWorkload = netpolWorkload
+)
+
+// Results of the http workload, grouped by the group of their target
+func reachResults(results []connTest) []netpolprotocol.ReachResult {
+	reached := make([]netpolprotocol.ReachResult, 0, len(results))
+	for _, ct := range results {
+		reached = append(reached, netpolprotocol.ReachResult{Address: ct.Address, Port: ct.Port, TargetIdx: ct.IngressIdx, Group: ct.NpName, Timestamp: ct.Timestamp})
+	}
+	return reached
+}
+
 func sendRequest(address string, port int) (bool, time.Time) {
 	url := fmt.Sprintf("http://%s:%d", address, port)
 	log.Printf("Sending request to address %s", address)
@@ -198,26 +230,43 @@ func processIngress(connTests []connTest, semaphore chan struct{}, tc int) {
 	}
 }
 
-// Return the results to kube-burner proxy pod
+// Return the results to kube-burner proxy pod, compressed when it accepts gzip
 func resultsHandler(w http.ResponseWriter, r *http.Request) {
 	resultsLock.Lock()
 	defer resultsLock.Unlock()
-	if err := json.NewEncoder(w).Encode(results); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	gw := netpolprotocol.NewResponseWriter(w, r)
+	defer gw.Close()
+	if err := json.NewEncoder(gw).Encode(activeWorkload.encode(results)); err != nil {
+		http.Error(gw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Return the current time by the clock of this pod, so the proxy pod can
+// estimate its offset and correct the timestamps of results
+func timeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(netpolprotocol.TimeResponse{Time: time.Now().UTC()}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-// Get connections from kube-burner proxy pod and create a local copy of
-// this information.
-func handleRequest(w http.ResponseWriter, r *http.Request) {
+// Get connections of workload wl from kube-burner proxy pod and create a
+// local copy of this information.
+func handleConnections(wl *workload) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleRequest(w, r, wl)
+	}
+}
+
+func handleRequest(w http.ResponseWriter, r *http.Request, wl *workload) {
 	fmt.Fprintln(w, "Check Request received, processing...")
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := netpolprotocol.RequestBody(r)
 	if err != nil {
 		http.Error(w, "Unable to read request body", http.StatusBadRequest)
 		return
 	}
 
-	err = json.Unmarshal(body, &connections)
+	err = json.NewDecoder(body).Decode(&connections)
 	if err != nil {
 		http.Error(w, "Unable to parse request body", http.StatusBadRequest)
 		return
@@ -226,11 +275,14 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	for connectionIdx, connection := range connections {
 		for _, address := range connection.Addresses {
 			for _, port := range connection.Ports {
-				allConnTests = append(allConnTests, connTest{Address: address, Port: port, IngressIdx: connectionIdx, NpName: connection.Netpol})
+				allConnTests = append(allConnTests, connTest{Address: address, Port: int(port), IngressIdx: connectionIdx, NpName: connection.Netpol})
 			}
 		}
 	}
-	r.Body.Close()
+	body.Close()
+	resultsLock.Lock()
+	activeWorkload = wl
+	resultsLock.Unlock()
 	log.Println("Finished sending Connections info")
 	gotConnectins <- true
 }
@@ -240,9 +292,14 @@ func sendRequests() {
 	// Wait till we get connections from kube-burner proxy pod
 	<-gotConnectins
 	// Wait till kube-burner creates job's objects
-	log.Println("Start waiting for Network policy object creation ", allConnTests)
-	waitForJobStarted(allConnTests)
-	log.Println("Finished waiting for Network policy object creation ")
+	if activeWorkload.waitForJob {
+		log.Println("Start waiting for Network policy object creation ", allConnTests)
+		waitForJobStarted(allConnTests)
+		log.Println("Finished waiting for Network policy object creation ")
+	}
+	if proxy != nil {
+		go pushResults()
+	}
 	// Start a dedicated thread for processing failed connections
 	go processFailed()
 	// Use 20 parallel threads for connection testing.
@@ -261,6 +318,54 @@ func sendRequests() {
 	wg.Wait()
 }
 
+// Certificate and key to serve HTTPS with, plain HTTP when unset
+var tlsCertFile, tlsKeyFile string
+
+// Results are pushed to the proxy pod's /report endpoint when proxy is set
+var (
+	proxy *netpolprotocol.ProxyClient
+	// key of this client pod in the connections of the proxy pod: its name
+	// when the proxy pod reaches client pods by name, its IP otherwise
+	podKey       string
+	pushInterval = 5 * time.Second
+)
+
+// Push new results to the proxy pod every pushInterval. Once all connections
+// succeeded, a final batch tells the proxy pod there is nothing left to report.
+func pushResults() {
+	expected := make(map[string]bool)
+	for _, ct := range allConnTests {
+		expected[fmt.Sprintf("%s:%d:%s", ct.Address, ct.Port, ct.NpName)] = true
+	}
+	reported := make(map[string]bool)
+	sent := 0
+	for {
+		time.Sleep(pushInterval)
+		resultsLock.Lock()
+		batch := append([]connTest(nil), results[sent:]...)
+		resultsLock.Unlock()
+		for _, ct := range batch {
+			reported[fmt.Sprintf("%s:%d:%s", ct.Address, ct.Port, ct.NpName)] = true
+		}
+		final := len(reported) >= len(expected)
+		if len(batch) == 0 && !final {
+			continue
+		}
+		report := netpolprotocol.ResultsReport{Pod: podKey, Final: final}
+		activeWorkload.addToReport(&report, batch)
+		if _, err := proxy.Report(context.Background(), report); err != nil {
+			// the batch is sent again with the next one
+			log.Printf("Failed to push %d results to proxy pod: %v", len(batch), err)
+			continue
+		}
+		sent += len(batch)
+		if final {
+			log.Printf("Pushed final results to proxy pod, %d connections succeeded", len(reported))
+			return
+		}
+	}
+}
+
 func processEnvVars() {
 	var err error
 	parallelConnectionsStr := os.Getenv("PARALLEL_CONNECTIONS")
@@ -270,15 +375,53 @@ func processEnvVars() {
 			panic(fmt.Sprintf("failed to parse env PARALLEL_CONNECTIONS: %v", err))
 		}
 	}
+	if proxyURL := os.Getenv("PROXY_URL"); proxyURL != "" {
+		proxy = &netpolprotocol.ProxyClient{HTTPClient: &http.Client{Timeout: 10 * time.Second}, BaseURL: proxyURL}
+	}
+	podKey = os.Getenv("POD_IP")
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		podKey = podName
+	}
+	if pushIntervalStr := os.Getenv("PUSH_INTERVAL"); pushIntervalStr != "" {
+		pushInterval, err = time.ParseDuration(pushIntervalStr)
+		if err != nil || pushInterval <= 0 {
+			panic(fmt.Sprintf("failed to parse env PUSH_INTERVAL: %q", pushIntervalStr))
+		}
+	}
+	if proxyGzip := os.Getenv("PROXY_GZIP"); proxyGzip != "" && proxy != nil {
+		proxy.Compress, err = strconv.ParseBool(proxyGzip)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse env PROXY_GZIP: %v", err))
+		}
+	}
+	if tokenFile := os.Getenv("PROXY_TOKEN_FILE"); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			panic(fmt.Sprintf("failed to read PROXY_TOKEN_FILE: %v", err))
+		}
+		if proxy != nil {
+			proxy.Token = strings.TrimSpace(string(token))
+		}
+	}
+	tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile = os.Getenv("TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		panic("both TLS_CERT_FILE and TLS_KEY_FILE are required to serve HTTPS")
+	}
 }
 
 func main() {
 	processEnvVars()
 	go sendRequests()
-	http.HandleFunc("/check", handleRequest)
+	http.HandleFunc("/check", handleConnections(netpolWorkload))
+	http.HandleFunc("/reach", handleConnections(reachWorkload))
 	http.HandleFunc("/results", resultsHandler)
+	http.HandleFunc("/time", timeHandler)
 	log.Println("Server started on 127.0.0.1:9001")
 	go func() {
+		if tlsCertFile != "" {
+			log.Fatal(http.ListenAndServeTLS(":9001", tlsCertFile, tlsKeyFile, nil))
+		}
 		log.Fatal(http.ListenAndServe(":9001", nil))
 	}()
 